@@ -1,12 +1,32 @@
 package sqlclone
 
-import (
-	"fmt"
-)
-
 type downloadOptions struct {
 	start_points []startPoint
 	dont_recurse []string
+	schemas      []string
+	masks        []columnMask
+	filters      []rowFilter
+	// references are only followed in one direction if set
+	parents_only  bool
+	children_only bool
+	// the maximum number of references followed to parents and to children, 0 if unlimited
+	max_parent_depth int
+	max_child_depth  int
+	dont_follow      []referenceColumn
+	// the maximum number of rows and bytes of the dump, 0 if unlimited
+	max_rows           int
+	max_rows_per_table []tableLimit
+	max_bytes          int
+	// records why each row was included, if set
+	provenance *Provenance
+	logger     Logger
+	progress   Progress
+}
+
+// the maximum number of rows of a table
+type tableLimit struct {
+	table string
+	n     int
 }
 
 type startPoint struct {
@@ -30,7 +50,11 @@ func NewDownloadOptions(opts ...DownloadOption) (*downloadOptions, error) {
 	}
 
 	if len(do.start_points) == 0 {
-		return nil, fmt.Errorf("starting point for cloning is missing")
+		return nil, ErrNoStartPoint
+	}
+
+	if len(do.schemas) == 0 {
+		do.schemas = []string{"public"}
 	}
 
 	// return the modified DownloadOptions instance
@@ -55,3 +79,174 @@ func DontRecurse(table string) DownloadOption {
 		do.dont_recurse = append(do.dont_recurse, table)
 	}
 }
+
+// Specify which schemas of the source database should be included during cloning.
+// defaults to the public schema. table names without a schema are looked up in the
+// included schemas in the given order
+func Schemas(schemas ...string) DownloadOption {
+	return func(do *downloadOptions) {
+		do.schemas = append(do.schemas, schemas...)
+	}
+}
+
+// Mask the values of a column with a Masker before they are added to the DatabaseDump.
+// the rows are still looked up with their original values. masking a column that is
+// part of a reference requires the referencing columns to be masked with the same masker,
+// which has to keep distinct values distinct and of the column type, e.g. FormatPreservingMasker.
+// HashMasker keeps values distinct too, but only fits text columns
+func Mask(table string, column string, m Masker) DownloadOption {
+	return func(do *downloadOptions) {
+		do.masks = append(do.masks, columnMask{table: table, column: column, masker: m})
+	}
+}
+
+// Only include rows of a table that fulfill an SQL predicate, e.g. "created_at > now() - interval '30 days'".
+// the predicate refers to its arguments as $1, $2, ... and is added to every lookup of rows of the table,
+// including the starting points. multiple filters of the same table all have to be fulfilled
+func FilterTable(table string, predicate string, args ...interface{}) DownloadOption {
+	return func(do *downloadOptions) {
+		do.filters = append(do.filters, rowFilter{table: table, predicate: predicate, args: args})
+	}
+}
+
+// Only follow references from a row to the rows it references, which is all that is
+// needed to keep the referential integrity of the starting points
+func ParentsOnly() DownloadOption {
+	return func(do *downloadOptions) {
+		do.parents_only = true
+	}
+}
+
+// Only follow references from a row to the rows that reference it. the parents of the
+// downloaded rows aren't included, so the dump can't be uploaded on its own
+func ChildrenOnly() DownloadOption {
+	return func(do *downloadOptions) {
+		do.children_only = true
+	}
+}
+
+// Limit how many references to parents are followed from a starting point
+func MaxParentDepth(n int) DownloadOption {
+	return func(do *downloadOptions) {
+		do.max_parent_depth = n
+	}
+}
+
+// Limit how many references to children are followed from a starting point
+func MaxChildDepth(n int) DownloadOption {
+	return func(do *downloadOptions) {
+		do.max_child_depth = n
+	}
+}
+
+// Don't follow a single reference in either direction, given as "table.column" or
+// "table.constraint_name". unlike DontRecurse, the referenced table can still be
+// reached through other references
+func DontFollow(reference string) DownloadOption {
+	return func(do *downloadOptions) {
+		do.dont_follow = append(do.dont_follow, parseReferenceColumn(reference))
+	}
+}
+
+// Stop the download with a *LimitError once the dump would contain more than n rows
+func MaxRows(n int) DownloadOption {
+	return func(do *downloadOptions) {
+		do.max_rows = n
+	}
+}
+
+// Stop the download with a *LimitError once the dump would contain more than n rows of a table
+func MaxRowsPerTable(table string, n int) DownloadOption {
+	return func(do *downloadOptions) {
+		do.max_rows_per_table = append(do.max_rows_per_table, tableLimit{table: table, n: n})
+	}
+}
+
+// Stop the download with a *LimitError once the dump would grow larger than about n bytes.
+// the size of a row is estimated from the length of its column names and values
+func MaxBytes(n int) DownloadOption {
+	return func(do *downloadOptions) {
+		do.max_bytes = n
+	}
+}
+
+// Record for every downloaded row from which starting point and through which chain
+// of references it was reached. p is filled when the download runs
+func RecordProvenance(p *Provenance) DownloadOption {
+	return func(do *downloadOptions) {
+		do.provenance = p
+	}
+}
+
+// Log the queries on the source database at debug level
+func DownloadLogger(l Logger) DownloadOption {
+	return func(do *downloadOptions) {
+		do.logger = l
+	}
+}
+
+// Report the number of downloaded rows per table after every query
+func DownloadProgress(p Progress) DownloadOption {
+	return func(do *downloadOptions) {
+		do.progress = p
+	}
+}
+
+// whether a reference was excluded with DontFollow
+func (do *downloadOptions) isNotFollowed(r TableReference) bool {
+	for _, rc := range do.dont_follow {
+		if rc.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a copy of the options in which all table names are qualified with
+// the first of the included schemas that contains the table
+func (do *downloadOptions) resolve(tables []string) *downloadOptions {
+	ret := &downloadOptions{
+		start_points: make([]startPoint, len(do.start_points)),
+		dont_recurse: make([]string, len(do.dont_recurse)),
+		schemas:      do.schemas,
+		masks:        make([]columnMask, len(do.masks)),
+		filters:      make([]rowFilter, len(do.filters)),
+		dont_follow:  make([]referenceColumn, len(do.dont_follow)),
+
+		parents_only:     do.parents_only,
+		children_only:    do.children_only,
+		max_parent_depth: do.max_parent_depth,
+		max_child_depth:  do.max_child_depth,
+
+		max_rows:           do.max_rows,
+		max_rows_per_table: make([]tableLimit, len(do.max_rows_per_table)),
+		max_bytes:          do.max_bytes,
+		provenance:         do.provenance,
+		logger:             do.logger,
+		progress:           do.progress,
+	}
+	for i, sp := range do.start_points {
+		ret.start_points[i] = sp
+		ret.start_points[i].table = resolveTable(tables, do.schemas, sp.table)
+	}
+	for i, t := range do.dont_recurse {
+		ret.dont_recurse[i] = resolveTable(tables, do.schemas, t)
+	}
+	for i, m := range do.masks {
+		ret.masks[i] = m
+		ret.masks[i].table = resolveTable(tables, do.schemas, m.table)
+	}
+	for i, f := range do.filters {
+		ret.filters[i] = f
+		ret.filters[i].table = resolveTable(tables, do.schemas, f.table)
+	}
+	for i, rc := range do.dont_follow {
+		ret.dont_follow[i] = rc
+		ret.dont_follow[i].table = resolveTable(tables, do.schemas, rc.table)
+	}
+	for i, l := range do.max_rows_per_table {
+		ret.max_rows_per_table[i] = l
+		ret.max_rows_per_table[i].table = resolveTable(tables, do.schemas, l.table)
+	}
+	return ret
+}
@@ -0,0 +1,328 @@
+package sqlclone
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	dump_format  = "sqlclone-dump"
+	dump_version = 1
+)
+
+// Schema describes the tables of the source database of a dump
+type Schema struct {
+	Tables []TableSchema `json:"tables"`
+}
+
+type TableSchema struct {
+	Name       string            `json:"name"`
+	Columns    []ColumnSchema    `json:"columns"`
+	PrimaryKey []string          `json:"primary_key,omitempty"`
+	References []ReferenceSchema `json:"references,omitempty"`
+}
+
+type ColumnSchema struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+type ReferenceSchema struct {
+	Name              string   `json:"name,omitempty"`
+	Columns           []string `json:"columns"`
+	ReferencedTable   string   `json:"referenced_table"`
+	ReferencedColumns []string `json:"referenced_columns"`
+}
+
+// a single line of a dump file. the first line contains the header, followed by
+// a line that starts each table and one line per row of that table
+type dumpRecord struct {
+	Format  string       `json:"format,omitempty"`
+	Version int          `json:"version,omitempty"`
+	Schema  *Schema      `json:"schema,omitempty"`
+	Table   string       `json:"table,omitempty"`
+	Columns []string     `json:"columns,omitempty"`
+	Row     []typedValue `json:"row,omitempty"`
+}
+
+// read the schema of all tables in a database
+func readSchema(ctx context.Context, db database) (*Schema, error) {
+	tables, err := db.getTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := db.getColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	primary_keys, err := db.getPrimaryKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	references, err := db.getReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{Tables: make([]TableSchema, 0, len(tables))}
+	for _, t := range dependencyOrderOfAll(tables, references, columns) {
+		ts := TableSchema{Name: t, Columns: make([]ColumnSchema, 0), PrimaryKey: primary_keys[t]}
+		for _, c := range columns[t] {
+			ts.Columns = append(ts.Columns, ColumnSchema{Name: c.name, Type: c.data_type, Nullable: c.nullable})
+		}
+		for _, d := range references[t] {
+			ts.References = append(ts.References, ReferenceSchema{
+				Name:              d.constraint_name,
+				Columns:           d.column_names,
+				ReferencedTable:   d.referenced_table_name,
+				ReferencedColumns: d.referenced_column_names,
+			})
+		}
+		schema.Tables = append(schema.Tables, ts)
+	}
+	return schema, nil
+}
+
+// get the schema of a table, nil if the schema doesn't contain the table
+func (s *Schema) table(table_name string) *TableSchema {
+	for i := range s.Tables {
+		if s.Tables[i].Name == table_name {
+			return &s.Tables[i]
+		}
+	}
+	return nil
+}
+
+func (s *Schema) tableNames() []string {
+	ret := make([]string, len(s.Tables))
+	for i, t := range s.Tables {
+		ret[i] = t.Name
+	}
+	return ret
+}
+
+func (s *Schema) references() References {
+	references := make(References)
+	for _, t := range s.Tables {
+		for _, d := range t.References {
+			references[t.Name] = append(references[t.Name], *NewCompositeTableReference(d.Name, t.Name, d.Columns, d.ReferencedTable, d.ReferencedColumns))
+		}
+	}
+	return references
+}
+
+// DumpWriter writes a dump file table by table, so that the rows of a dump don't have to be
+// held in memory at once. tables should be written in the order of the schema, which
+// lists referenced tables first, so that they can be uploaded while reading the file
+type DumpWriter struct {
+	enc    *json.Encoder
+	schema *Schema
+}
+
+// Constructor function, writes the header with the schema of the source database
+func NewDumpWriter(w io.Writer, schema *Schema) (*DumpWriter, error) {
+	if schema == nil {
+		schema = &Schema{Tables: make([]TableSchema, 0)}
+	}
+	dw := &DumpWriter{enc: json.NewEncoder(w), schema: schema}
+	if err := dw.enc.Encode(dumpRecord{Format: dump_format, Version: dump_version, Schema: schema}); err != nil {
+		return nil, fmt.Errorf("error writing dump header: %w", err)
+	}
+	return dw, nil
+}
+
+// write the rows of a table. columns are written in the order of the schema,
+// columns that are missing in a row are written as NULL
+func (dw *DumpWriter) WriteTable(table_name string, rows []map[string]interface{}) error {
+	columns := rowColumns(rows)
+	if ts := dw.schema.table(table_name); ts != nil {
+		ordered := make([]string, 0, len(columns))
+		for _, c := range ts.Columns {
+			if sliceContains(columns, c.Name) {
+				ordered = append(ordered, c.Name)
+			}
+		}
+		for _, c := range columns {
+			if !sliceContains(ordered, c) {
+				return fmt.Errorf("column %q of table %q is not part of the schema", c, table_name)
+			}
+		}
+		columns = ordered
+	}
+
+	if err := dw.enc.Encode(dumpRecord{Table: table_name, Columns: columns}); err != nil {
+		return fmt.Errorf("error writing table %q: %w", table_name, err)
+	}
+	for _, r := range rows {
+		values := make([]typedValue, len(columns))
+		for i, c := range columns {
+			values[i] = typedValue{r[c]}
+		}
+		if err := dw.enc.Encode(dumpRecord{Row: values}); err != nil {
+			return fmt.Errorf("error writing row of table %q: %w", table_name, err)
+		}
+	}
+	return nil
+}
+
+// DumpReader reads a dump file table by table
+type DumpReader struct {
+	dec    *json.Decoder
+	schema *Schema
+	next   *dumpRecord // table record that was read ahead
+}
+
+// Constructor function, reads the header of the dump file
+func NewDumpReader(r io.Reader) (*DumpReader, error) {
+	dr := &DumpReader{dec: json.NewDecoder(r)}
+
+	var header dumpRecord
+	if err := dr.dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("error reading dump header: %w", err)
+	}
+	if header.Format != dump_format {
+		return nil, fmt.Errorf("input is not a dump file")
+	}
+	if header.Version != dump_version {
+		return nil, fmt.Errorf("dump file has unsupported version %d", header.Version)
+	}
+	dr.schema = header.Schema
+	if dr.schema == nil {
+		dr.schema = &Schema{Tables: make([]TableSchema, 0)}
+	}
+	return dr, nil
+}
+
+// get the schema of the source database as written in the header
+func (dr *DumpReader) Schema() *Schema {
+	return dr.schema
+}
+
+// read the rows of the next table. returns io.EOF after the last table
+func (dr *DumpReader) NextTable() (string, []map[string]interface{}, error) {
+	header := dr.next
+	dr.next = nil
+	if header == nil {
+		header = &dumpRecord{}
+		if err := dr.dec.Decode(header); err != nil {
+			if err == io.EOF {
+				return "", nil, io.EOF
+			}
+			return "", nil, fmt.Errorf("error reading dump file: %w", err)
+		}
+	}
+	if header.Table == "" {
+		return "", nil, fmt.Errorf("dump file contains a row outside of a table")
+	}
+
+	rows := make([]map[string]interface{}, 0)
+	for {
+		var record dumpRecord
+		if err := dr.dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return "", nil, fmt.Errorf("error reading rows of table %q: %w", header.Table, err)
+		}
+		if record.Table != "" {
+			dr.next = &record
+			break
+		}
+		if len(record.Row) != len(header.Columns) {
+			return "", nil, fmt.Errorf("row of table %q has %d values instead of %d", header.Table, len(record.Row), len(header.Columns))
+		}
+		row := make(map[string]interface{}, len(header.Columns))
+		for i, c := range header.Columns {
+			row[c] = record.Row[i].value
+		}
+		rows = append(rows, row)
+	}
+	return header.Table, rows, nil
+}
+
+// write a complete dump to a dump file. tables are written in the order of the schema,
+// which has to contain all tables of the dump. without a schema, tables are written in
+// alphabetical order and uploaded in the order of the target database
+func WriteDump(w io.Writer, schema *Schema, data DatabaseDump) error {
+	rest := make([]string, 0)
+	for t := range data {
+		if schema != nil && len(schema.Tables) > 0 && schema.table(t) == nil {
+			return fmt.Errorf("table %q is not part of the schema", t)
+		}
+		if schema == nil || len(schema.Tables) == 0 {
+			rest = append(rest, t)
+		}
+	}
+	sort.Strings(rest)
+
+	dw, err := NewDumpWriter(w, schema)
+	if err != nil {
+		return err
+	}
+
+	order := make([]string, 0, len(data))
+	for _, t := range dw.schema.tableNames() {
+		if _, exists := data[t]; exists {
+			order = append(order, t)
+		}
+	}
+
+	for _, t := range append(order, rest...) {
+		if err := dw.WriteTable(t, data[t]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read a complete dump file into memory
+func ReadDump(r io.Reader) (*Schema, DatabaseDump, error) {
+	dr, err := NewDumpReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := dr.readAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	return dr.Schema(), data, nil
+}
+
+// read all remaining tables of a dump file into memory
+func (dr *DumpReader) readAll() (DatabaseDump, error) {
+	data := make(DatabaseDump)
+	for {
+		t, rows, err := dr.NextTable()
+		if err == io.EOF {
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		data[t] = append(data[t], rows...)
+	}
+}
+
+// get the columns of a list of rows in sorted order
+func rowColumns(rows []map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	columns := make([]string, 0)
+	for _, r := range rows {
+		for c := range r {
+			if !seen[c] {
+				seen[c] = true
+				columns = append(columns, c)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
@@ -0,0 +1,170 @@
+package sqlclone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDumpFile(t *testing.T) {
+	mockdb := dataMockDB{
+		references: References{
+			"public.purchase": {*NewTableReference("public.purchase", "person_id", "public.person", "id")},
+		},
+		primary_keys: map[string][]string{"public.person": {"id"}},
+		columns: map[string][]column{
+			"public.person":   {{"id", "bigint", false}, {"name", "text", true}, {"avatar", "bytea", true}},
+			"public.purchase": {{"person_id", "bigint", false}, {"price", "double precision", false}, {"paid_at", "timestamp with time zone", true}},
+		},
+		order: []string{"public.purchase", "public.person"},
+	}
+	schema, err := readSchema(context.Background(), &mockdb)
+	if err != nil {
+		t.Fatalf("readSchema() returned unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(schema.tableNames(), []string{"public.person", "public.purchase"}) {
+		t.Errorf("readSchema() didn't order the tables by their dependencies: %v", schema.tableNames())
+	}
+
+	paid_at := time.Date(2023, 11, 22, 10, 30, 0, 123456789, time.UTC)
+	data := DatabaseDump{
+		"public.purchase": {{"person_id": int64(1200000), "price": 145.40203494, "paid_at": paid_at}},
+		"public.person":   {{"id": int64(1200000), "name": "Fred", "avatar": []byte{0x00, 0xff}}, {"id": int64(2), "name": nil, "avatar": nil}},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteDump(&buf, schema, data); err != nil {
+		t.Fatalf("WriteDump() returned unexpected error: %v", err)
+	}
+
+	read_schema, result, err := ReadDump(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ReadDump() returned unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(read_schema, schema) {
+		t.Errorf("ReadDump() returned unexpected schema: \n expected schema: %v \n returned schema: %v", schema, read_schema)
+	}
+	if !compareDumps(result, data) {
+		t.Errorf("ReadDump() returned unexpected result: \n expected result: %v \n returned result: %v", data, result)
+	}
+
+	// the tables are uploaded in the order of the file
+	target := dataMockDB{
+		tables:            map[string][]map[string]interface{}{},
+		references:        mockdb.references,
+		primary_keys:      mockdb.primary_keys,
+		generated_columns: map[string][]string{"public.person": {"id"}},
+		order:             mockdb.order,
+	}
+	dr, err := NewDumpReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewDumpReader() returned unexpected error: %v", err)
+	}
+	mapping, err := uploadDump(context.Background(), func([]string) database { return &target }, dr, newUploadOptions())
+	if err != nil {
+		t.Fatalf("uploadDump() returned unexpected error: %v", err)
+	}
+	expected_mapping := Mapping{"public.person": {"1200000": "100", "2": "101"}}
+	if !reflect.DeepEqual(mapping, expected_mapping) {
+		t.Errorf("uploadDump() returned unexpected result: \n expected result: %v \n returned result: %v", expected_mapping, mapping)
+	}
+	if target.tables["public.purchase"][0]["person_id"] != 100 {
+		t.Errorf("uploadDump() inserted unexpected rows: %v", target.tables["public.purchase"])
+	}
+
+	if _, err := NewDumpReader(bytes.NewReader([]byte(`{"format":"something-else"}`))); err == nil {
+		t.Errorf("NewDumpReader() accepted input that is not a dump file")
+	}
+}
+
+func TestDumpFileWithoutSchema(t *testing.T) {
+	// written in alphabetical order, so the referencing table comes first
+	data := DatabaseDump{
+		"invoice": {{"id": int64(1), "person_id": int64(7)}},
+		"person":  {{"id": int64(7), "name": "Fred"}},
+	}
+	var buf bytes.Buffer
+	if err := WriteDump(&buf, nil, data); err != nil {
+		t.Fatalf("WriteDump() returned unexpected error: %v", err)
+	}
+
+	target := dataMockDB{
+		tables:            map[string][]map[string]interface{}{},
+		references:        References{"public.invoice": {*NewTableReference("public.invoice", "person_id", "public.person", "id")}},
+		primary_keys:      map[string][]string{"public.person": {"id"}, "public.invoice": {"id"}},
+		generated_columns: map[string][]string{"public.person": {"id"}, "public.invoice": {"id"}},
+		order:             []string{"public.person", "public.invoice"},
+	}
+	dr, err := NewDumpReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewDumpReader() returned unexpected error: %v", err)
+	}
+	var schemas []string
+	if _, err := uploadDump(context.Background(), func(s []string) database { schemas = s; return &target }, dr, newUploadOptions()); err != nil {
+		t.Fatalf("uploadDump() returned unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(schemas, []string{"public"}) {
+		t.Errorf("uploadDump() read unexpected schemas of the target database: %v", schemas)
+	}
+	if target.tables["public.invoice"][0]["person_id"] != 100 {
+		t.Errorf("uploadDump() inserted unexpected rows: %v", target.tables)
+	}
+
+	schema := &Schema{Tables: []TableSchema{{Name: "person", Columns: []ColumnSchema{{Name: "id", Type: "bigint"}}}}}
+	if err := WriteDump(&buf, schema, data); err == nil {
+		t.Errorf("WriteDump() accepted a table that is not part of the schema")
+	}
+}
+
+func TestDatabaseDumpJSON(t *testing.T) {
+	data := DatabaseDump{
+		"public.invoice": {{
+			"id":         int64(1 << 62),
+			"small_id":   int64(1200000),
+			"big_id":     uint64(1<<63 + 1),
+			"total":      Numeric("12.3400"),
+			"ratio":      0.25,
+			"token":      UUID("9cf973a1-63e1-4967-855e-87bdccf0a6f7"),
+			"meta":       JSON(`{"admin":true}`),
+			"tags":       Array(`{a,b}`),
+			"pdf":        []byte{0x25, 0x50, 0x44, 0x46},
+			"created_at": time.Date(2023, 11, 22, 10, 30, 0, 123456789, time.FixedZone("", 3600)),
+			"paid":       true,
+			"note":       nil,
+			"title":      "1.2e+06",
+		}},
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("json.Marshal() returned unexpected error: %v", err)
+	}
+	result := make(DatabaseDump)
+	if err := json.Unmarshal(b, &result); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+
+	row, expected_row := result["public.invoice"][0], data["public.invoice"][0]
+	for c, v := range expected_row {
+		if tm, ok := v.(time.Time); ok {
+			if !tm.Equal(row[c].(time.Time)) {
+				t.Errorf("json round trip changed column %s from %v to %v", c, v, row[c])
+			}
+		} else if !reflect.DeepEqual(v, row[c]) {
+			t.Errorf("json round trip changed column %s from %v (%T) to %v (%T)", c, v, v, row[c], row[c])
+		}
+	}
+
+	// dumps that were marshaled without type information can still be read
+	var untyped DatabaseDump
+	if err := json.Unmarshal([]byte(`{"person":[{"id":1200000,"price":1.5,"name":"Fred"}]}`), &untyped); err != nil {
+		t.Fatalf("json.Unmarshal() returned unexpected error: %v", err)
+	}
+	expected_untyped := DatabaseDump{"person": {{"id": int64(1200000), "price": 1.5, "name": "Fred"}}}
+	if !reflect.DeepEqual(untyped, expected_untyped) {
+		t.Errorf("json.Unmarshal() returned unexpected result: \n expected result: %v \n returned result: %v", expected_untyped, untyped)
+	}
+}
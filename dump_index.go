@@ -0,0 +1,122 @@
+package sqlclone
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// index over the rows of a DatabaseDump. rows are identified by their primary key,
+// or by a hash over all of their values if the table has no primary key.
+// the rows are identified by the values read from the database, before any masking
+type dumpIndex struct {
+	primary_keys map[string][]string
+	rows         map[string]map[string]bool
+}
+
+// Constructor function
+func newDumpIndex(primary_keys map[string][]string) *dumpIndex {
+	return &dumpIndex{
+		primary_keys: primary_keys,
+		rows:         make(map[string]map[string]bool),
+	}
+}
+
+// add a row to the index, unless it is already contained. returns whether the row was added
+func (i *dumpIndex) add(table_name string, row map[string]interface{}) bool {
+	key := i.rowKey(table_name, row)
+	if i.rows[table_name] == nil {
+		i.rows[table_name] = make(map[string]bool)
+	}
+	if i.rows[table_name][key] {
+		return false
+	}
+	i.rows[table_name][key] = true
+	return true
+}
+
+func (i *dumpIndex) rowKey(table_name string, row map[string]interface{}) string {
+	if primary_key := i.primary_keys[table_name]; len(primary_key) > 0 {
+		return canonicalTuple(rowValues(row, primary_key))
+	}
+
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+
+	h := sha256.New()
+	for _, c := range columns {
+		h.Write([]byte(canonicalTuple([]interface{}{c, row[c]})))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// set of lookups that were already executed, identified by table, columns and values
+type lookupIndex map[string]bool
+
+// add a lookup to the index. returns false if it was already contained
+func (i lookupIndex) add(table_name string, columns []string, values []interface{}) bool {
+	key := lookupKey(table_name, columns, values)
+	if i[key] {
+		return false
+	}
+	i[key] = true
+	return true
+}
+
+func (i lookupIndex) contains(table_name string, columns []string, values []interface{}) bool {
+	return i[lookupKey(table_name, columns, values)]
+}
+
+func lookupKey(table_name string, columns []string, values []interface{}) string {
+	return table_name + "\x00" + strings.Join(columns, "\x00") + "\x00" + canonicalTuple(values)
+}
+
+// encode a tuple of values so that two tuples have the same encoding if and only if their values are equal
+func canonicalTuple(values []interface{}) string {
+	var b strings.Builder
+	for _, v := range values {
+		s := canonicalValue(v)
+		b.WriteString(strconv.Itoa(len(s)))
+		b.WriteByte(':')
+		b.WriteString(s)
+	}
+	return b.String()
+}
+
+// encode a value together with its kind. integers of different sizes are encoded alike,
+// as the database driver and callers don't necessarily agree on the size
+func canonicalValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "n"
+	case []byte:
+		return "b" + hex.EncodeToString(v)
+	case string:
+		return "s" + v
+	case bool:
+		return "l" + strconv.FormatBool(v)
+	case time.Time:
+		return "t" + v.UTC().Format(time.RFC3339Nano)
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "i" + strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "i" + strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return "f" + strconv.FormatFloat(rv.Float(), 'g', -1, 64)
+	case reflect.String:
+		return "s" + rv.String()
+	}
+	return fmt.Sprintf("%T:%v", val, val)
+}
@@ -0,0 +1,112 @@
+package sqlclone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoStartPoint is returned by NewDownloadOptions if no starting point was included
+var ErrNoStartPoint = errors.New("starting point for cloning is missing")
+
+// QueryError is returned if a query on the database fails
+type QueryError struct {
+	// the table and columns by which rows were looked up, empty for queries of the schema.
+	// only the table is set for statements that insert or update rows
+	Table  string
+	Column string
+	Query  string
+	Err    error
+}
+
+func (e *QueryError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("query could not be executed: %q resulting in error: %v", e.Query, e.Err)
+	}
+	if e.Column == "" {
+		return fmt.Sprintf("query on table %q could not be executed: %q resulting in error: %v", e.Table, e.Query, e.Err)
+	}
+	return fmt.Sprintf("query on %q of table %q could not be executed: %q resulting in error: %v", e.Column, e.Table, e.Query, e.Err)
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// InsertError is returned by Upload if rows of a table could not be inserted. as rows are
+// inserted in batches, it reports the positions of the first and last row of the failed batch.
+// if the deferred references of a row could not be set, both positions are those of that row
+type InsertError struct {
+	Table    string
+	FirstRow int
+	LastRow  int
+	Err      error
+}
+
+func (e *InsertError) Error() string {
+	return fmt.Sprintf("rows %d to %d of table %q could not be uploaded: %v", e.FirstRow, e.LastRow, e.Table, e.Err)
+}
+
+func (e *InsertError) Unwrap() error {
+	return e.Err
+}
+
+// SchemaMismatchError is returned by Upload if a table or column of the dump doesn't exist
+// in the target database. Column is empty if the whole table is missing
+type SchemaMismatchError struct {
+	Table  string
+	Column string
+}
+
+func (e *SchemaMismatchError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("table %q doesn't exist in the target database", e.Table)
+	}
+	return fmt.Sprintf("column %q of table %q doesn't exist in the target database", e.Column, e.Table)
+}
+
+// CycleError is returned by Upload if tables reference each other in a cycle that can't be
+// broken, as none of the references of the cycle consists of nullable columns only
+type CycleError struct {
+	Tables []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("tables %s reference each other in a cycle without nullable references", strings.Join(e.Tables, ", "))
+}
+
+// UnmappedReferenceError is returned by Upload if a row references a row that is not part of the
+// upload, and the reference isn't handled otherwise with OnUnmapped or OnUnmappedReference
+type UnmappedReferenceError struct {
+	Table     string
+	Reference TableReference
+	// the referenced primary key in the source database
+	Values []interface{}
+}
+
+func (e *UnmappedReferenceError) Error() string {
+	return fmt.Sprintf("row of table %q references %v by %s, which is not part of the upload", e.Table, e.Values, e.Reference)
+}
+
+// SkippedTablesError is returned by Upload with SavepointPerTable if the rows of some tables could
+// not be uploaded. these tables were rolled back to their savepoints, the rows of all other tables
+// were committed. rows that reference rows of a skipped table fail as unmapped references
+type SkippedTablesError struct {
+	// the skipped tables in the order of the upload, and the error by which each of them failed
+	Tables []string
+	Errors []error
+	// the mapping of the committed rows
+	Mapping Mapping
+}
+
+func (e *SkippedTablesError) Error() string {
+	msgs := make([]string, len(e.Tables))
+	for i, t := range e.Tables {
+		msgs[i] = fmt.Sprintf("%q: %v", t, e.Errors[i])
+	}
+	return fmt.Sprintf("%d tables could not be uploaded and were skipped: %s", len(e.Tables), strings.Join(msgs, "; "))
+}
+
+func (e *SkippedTablesError) Unwrap() []error {
+	return e.Errors
+}
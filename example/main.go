@@ -1,9 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"sqlclone"
 )
 
@@ -24,29 +24,34 @@ func main() {
 		log.Fatal(err)
 	}
 
-	dataBytes, err := json.Marshal(dump)
+	schema, err := sqlclone.ReadSchema(from_cp)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Println("data:")
-	fmt.Printf("%s", dataBytes)
-	fmt.Println()
+	// persist the dump together with the schema of the source database
+	f, err := os.Create("dump.jsonl")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sqlclone.WriteDump(f, schema, dump); err != nil {
+		log.Fatal(err)
+	}
+	f.Close()
 
-	newData := make(sqlclone.DatabaseDump)
-	err = json.Unmarshal(dataBytes, &newData)
+	f, err = os.Open("dump.jsonl")
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println(newData)
+	defer f.Close()
 
 	to_cp := sqlclone.NewConnectionParameters("localhost", 5432, "baay", "deneme", "db_sqlclone_to")
-	mm, err := sqlclone.Upload(to_cp, dump)
+	// the users aren't part of the dump, references to them keep their values as the target
+	// database is expected to contain the same users
+	mm, err := sqlclone.UploadDump(to_cp, f, sqlclone.OnUnmapped(sqlclone.UnmappedKeepOriginal))
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	fmt.Println(mm)
-	fmt.Println("hallo welt")
-
 }
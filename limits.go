@@ -0,0 +1,69 @@
+package sqlclone
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// LimitError is returned by Download when the dump exceeds one of the limits set with
+// MaxRows, MaxRowsPerTable or MaxBytes. it contains the rows that were downloaded so far
+type LimitError struct {
+	// the limit that was exceeded, e.g. "MaxRows(1000)"
+	Limit string
+	// the table of the row that exceeded the limit
+	Table string
+	// the reference that was followed to reach the row, nil if the row is a starting point
+	Reference *TableReference
+	// the rows that were downloaded before the limit was exceeded
+	Dump DatabaseDump
+}
+
+func (e *LimitError) Error() string {
+	if e.Reference == nil {
+		return fmt.Sprintf("download exceeded %s at a starting point in table %q", e.Limit, e.Table)
+	}
+	return fmt.Sprintf("download exceeded %s in table %q following %s", e.Limit, e.Table, e.Reference)
+}
+
+// counts the rows and bytes of a dump while it is downloaded
+type limitCounter struct {
+	options    *downloadOptions
+	rows       int
+	table_rows map[string]int
+	bytes      int
+}
+
+// Constructor function
+func newLimitCounter(options *downloadOptions) *limitCounter {
+	return &limitCounter{options: options, table_rows: make(map[string]int)}
+}
+
+// count a row that is about to be added to the dump. returns the name of the exceeded
+// limit, or an empty string if the row can be added
+func (c *limitCounter) add(table_name string, r map[string]interface{}) string {
+	c.rows++
+	c.table_rows[table_name]++
+	c.bytes += rowSize(r)
+
+	if c.options.max_rows > 0 && c.rows > c.options.max_rows {
+		return "MaxRows(" + strconv.Itoa(c.options.max_rows) + ")"
+	}
+	for _, l := range c.options.max_rows_per_table {
+		if l.table == table_name && c.table_rows[table_name] > l.n {
+			return fmt.Sprintf("MaxRowsPerTable(%q, %d)", l.table, l.n)
+		}
+	}
+	if c.options.max_bytes > 0 && c.bytes > c.options.max_bytes {
+		return "MaxBytes(" + strconv.Itoa(c.options.max_bytes) + ")"
+	}
+	return ""
+}
+
+// estimate the size of a row by the length of its column names and encoded values
+func rowSize(r map[string]interface{}) int {
+	size := 0
+	for c, v := range r {
+		size += len(c) + len(canonicalValue(v)) - 1
+	}
+	return size
+}
@@ -0,0 +1,22 @@
+package sqlclone
+
+import (
+	"context"
+)
+
+// Logger receives debug messages about the executed queries, with alternating keys
+// and values as arguments. a *slog.Logger can be used as a Logger
+type Logger interface {
+	DebugContext(ctx context.Context, msg string, args ...any)
+}
+
+// Progress is called with the name of a table and the number of its rows that were
+// downloaded or uploaded so far, whenever that number grows
+type Progress func(table string, rows int)
+
+// log a debug message if the database has a logger
+func (db postgresDB) debug(ctx context.Context, msg string, args ...any) {
+	if db.logger != nil {
+		db.logger.DebugContext(ctx, msg, args...)
+	}
+}
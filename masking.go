@@ -0,0 +1,210 @@
+package sqlclone
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// Masker replaces a column value by a masked value before it is added to the DatabaseDump.
+// maskers are deterministic: equal values are masked alike, so masked values that are
+// used as join keys still match. NULL values are passed to the masker as nil
+type Masker func(value interface{}) (interface{}, error)
+
+// a masker for a single column
+type columnMask struct {
+	table  string
+	column string
+	masker Masker
+}
+
+// Mask the values of a column with the hex encoded HMAC-SHA256 of the value, keyed with the salt
+func HashMasker(salt string) Masker {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return hex.EncodeToString(keyedHash(salt, value)), nil
+	}
+}
+
+// Mask the values of a column with a fake email address at the given domain, e.g. user_1a2b3c4d5e6f@example.com
+func FakeEmailMasker(salt string, domain string) Masker {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return "user_" + hex.EncodeToString(keyedHash(salt, value))[:12] + "@" + domain, nil
+	}
+}
+
+// Mask the values of a column with a fixed value. NULL values stay NULL
+func FixedMasker(fixed interface{}) Masker {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+		return fixed, nil
+	}
+}
+
+// Mask all values of a column with NULL
+func NullMasker() Masker {
+	return func(value interface{}) (interface{}, error) {
+		return nil, nil
+	}
+}
+
+// Mask the values of a column while keeping their format: ASCII letters are replaced by letters of
+// the same case, digits by digits and all other characters are kept. works for text and integer columns.
+// values of the same format are permuted, so distinct values stay distinct and the masker can be used
+// on both sides of a reference
+func FormatPreservingMasker(salt string) Masker {
+	return func(value interface{}) (interface{}, error) {
+		if value == nil {
+			return nil, nil
+		}
+
+		rv := reflect.ValueOf(value)
+		switch rv.Kind() {
+		case reflect.String:
+			masked := reflect.New(rv.Type()).Elem()
+			masked.SetString(preserveFormat(salt, rv.String()))
+			return masked.Interface(), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// a masked value that doesn't fit into the type is masked again until one fits. this
+			// cycle walking keeps the masking a permutation of the values that fit
+			masked := reflect.New(rv.Type()).Elem()
+			s := strconv.FormatInt(rv.Int(), 10)
+			for {
+				s = preserveFormat(salt, s)
+				if i, err := strconv.ParseInt(s, 10, 64); err == nil && !masked.OverflowInt(i) {
+					masked.SetInt(i)
+					return masked.Interface(), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("value of type %T can't be masked with a format preserving masker", value)
+	}
+}
+
+// number of rounds of the permutation in preserveFormat
+const format_rounds = 10
+
+// a character of a value that preserveFormat replaces: the character is a digit
+// of the given radix, whose zero is the rune base
+type formatDigit struct {
+	position int
+	base     rune
+	radix    int64
+}
+
+// replace letters and digits of s with a keyed permutation of all strings of the same format.
+// the replaced characters form a mixed radix number, which is split in two halves that are
+// alternately shifted by a keyed hash of the other half, like the rounds of a Feistel cipher.
+// the first digit of a number with several digits or a sign is never replaced by a zero and
+// never replaces a zero, so that numbers keep their number of digits
+func preserveFormat(salt string, s string) string {
+	runes := []rune(s)
+	digits := make([]formatDigit, 0, len(runes))
+	// the format is part of the hash, so strings of different formats are permuted independently
+	format := make([]rune, len(runes))
+	for i, r := range runes {
+		format[i] = r
+		first := i == 0 || (i == 1 && runes[0] == '-')
+		single := first && i == 0 && (len(runes) == 1 || runes[1] < '0' || runes[1] > '9')
+		switch {
+		case r == '0' && first && !single:
+			// a leading zero is kept, so that values with and without one stay apart
+		case r >= '1' && r <= '9' && first && !single:
+			digits = append(digits, formatDigit{i, '1', 9})
+			format[i] = 'N'
+		case r >= '0' && r <= '9':
+			digits = append(digits, formatDigit{i, '0', 10})
+			format[i] = '0'
+		case r >= 'A' && r <= 'Z':
+			digits = append(digits, formatDigit{i, 'A', 26})
+			format[i] = 'A'
+		case r >= 'a' && r <= 'z':
+			digits = append(digits, formatDigit{i, 'a', 26})
+			format[i] = 'a'
+		}
+	}
+	if len(digits) == 0 {
+		return s
+	}
+
+	// a single character can't be split, it is paired with an empty half and only shifted by a keyed constant
+	half := len(digits) / 2
+	left, right := digits[:half], digits[half:]
+	a, b := formatNumber(runes, left), formatNumber(runes, right)
+	a_size, b_size := formatSize(left), formatSize(right)
+	for round := 0; round < format_rounds; round++ {
+		if round%2 == 0 {
+			b.Add(b, formatRound(salt, string(format), round, a, b_size))
+			b.Mod(b, b_size)
+		} else {
+			a.Add(a, formatRound(salt, string(format), round, b, a_size))
+			a.Mod(a, a_size)
+		}
+	}
+	formatDigits(runes, left, a)
+	formatDigits(runes, right, b)
+	return string(runes)
+}
+
+// the value of the characters at the positions of the digits as a mixed radix number
+func formatNumber(runes []rune, digits []formatDigit) *big.Int {
+	n := new(big.Int)
+	for _, d := range digits {
+		n.Mul(n, big.NewInt(d.radix))
+		n.Add(n, big.NewInt(int64(runes[d.position]-d.base)))
+	}
+	return n
+}
+
+// write a mixed radix number to the positions of the digits
+func formatDigits(runes []rune, digits []formatDigit, n *big.Int) {
+	rest := new(big.Int).Set(n)
+	digit := new(big.Int)
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := digits[i]
+		rest.DivMod(rest, big.NewInt(d.radix), digit)
+		runes[d.position] = d.base + rune(digit.Int64())
+	}
+}
+
+// number of values that the digits can represent
+func formatSize(digits []formatDigit) *big.Int {
+	n := big.NewInt(1)
+	for _, d := range digits {
+		n.Mul(n, big.NewInt(d.radix))
+	}
+	return n
+}
+
+// the keyed hash of a round and the unchanged half, reduced modulo the size of the other half
+func formatRound(salt string, format string, round int, n *big.Int, size *big.Int) *big.Int {
+	mac := hmac.New(sha256.New, []byte(salt))
+	fmt.Fprintf(mac, "%s:%d:%s", format, round, n.String())
+	block := mac.Sum(nil)
+	// long values need more bits than a single hash has
+	for len(block)*8 < size.BitLen()+64 {
+		mac.Reset()
+		mac.Write(block)
+		block = append(block, mac.Sum(nil)...)
+	}
+	h := new(big.Int).SetBytes(block)
+	return h.Mod(h, size)
+}
+
+// HMAC-SHA256 of the canonical encoding of a value
+func keyedHash(salt string, value interface{}) []byte {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(canonicalValue(value)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,124 @@
+package sqlclone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DownloadPlan describes which rows a download would include, without the values of the rows
+type DownloadPlan struct {
+	Tables []TablePlan `json:"tables"`
+}
+
+// TablePlan describes how many rows of a table a download would include and through which
+// chains of references they are reached. a starting point is reached through an empty chain
+type TablePlan struct {
+	Name  string     `json:"name"`
+	Rows  int        `json:"rows"`
+	Paths [][]string `json:"paths"`
+}
+
+// walks the graph of references from the starting points as Download does, but only gets the
+// primary key and reference columns of each row, and all columns of tables without a primary key.
+// returns the number of rows per table in the order in which the tables are reached
+func Plan(cp *ConnectionParameters, options *downloadOptions) (*DownloadPlan, error) {
+	return PlanContext(context.Background(), cp, options)
+}
+
+// Plan that stops querying the source database once the context is done
+func PlanContext(ctx context.Context, cp *ConnectionParameters, options *downloadOptions) (*DownloadPlan, error) {
+	from_db, err := cp.open()
+	if err != nil {
+		return nil, err
+	}
+	defer from_db.Close()
+
+	return plan(ctx, postgresDB{queryer: from_db, schemas: options.schemas, logger: options.logger}, options)
+}
+
+func plan(ctx context.Context, db database, options *downloadOptions) (*DownloadPlan, error) {
+	w, start, err := newDownloadWalker(ctx, db, options)
+	if err != nil {
+		return nil, err
+	}
+	w.projections = planProjections(w.references, w.primary_keys, w.options.start_points)
+
+	ret := &DownloadPlan{Tables: make([]TablePlan, 0)}
+	positions := make(map[string]int)
+	paths := make(map[string]bool)
+	w.visit = func(l lookup, r map[string]interface{}) {
+		pos, exists := positions[l.table_name]
+		if !exists {
+			pos = len(ret.Tables)
+			positions[l.table_name] = pos
+			ret.Tables = append(ret.Tables, TablePlan{Name: l.table_name, Paths: make([][]string, 0)})
+		}
+		ret.Tables[pos].Rows++
+
+		path := make([]string, 0)
+		for _, ref := range l.path() {
+			path = append(path, ref.String())
+		}
+		key := l.table_name + "\x00" + strings.Join(path, "\x00")
+		if !paths[key] {
+			paths[key] = true
+			ret.Tables[pos].Paths = append(ret.Tables[pos].Paths, path)
+		}
+	}
+
+	if err := w.walk(ctx, start); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// renders the plan as text with one line per table followed by one line per chain of references
+func (p *DownloadPlan) String() string {
+	var b strings.Builder
+	for _, t := range p.Tables {
+		fmt.Fprintf(&b, "%s: %d rows\n", t.Name, t.Rows)
+		for _, path := range t.Paths {
+			if len(path) == 0 {
+				b.WriteString("  starting point\n")
+			} else {
+				b.WriteString("  " + strings.Join(path, ", ") + "\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// get the columns per table that are needed to follow the references: the primary key,
+// the columns of references in either direction and the columns of the starting points.
+// tables without a primary key are left out, so all of their columns are selected: their
+// rows are told apart by all values, and rows with the same key columns would collapse
+func planProjections(references References, primary_keys map[string][]string, start_points []startPoint) map[string][]string {
+	ret := make(map[string][]string)
+	add := func(table_name string, columns ...string) {
+		for _, c := range columns {
+			if !sliceContains(ret[table_name], c) {
+				ret[table_name] = append(ret[table_name], c)
+			}
+		}
+	}
+
+	for t, pk := range primary_keys {
+		add(t, pk...)
+	}
+	for _, refs := range references {
+		for _, r := range refs {
+			add(r.table_name, r.column_names...)
+			add(r.referenced_table_name, r.referenced_column_names...)
+		}
+	}
+	for _, sp := range start_points {
+		add(sp.table, sp.column)
+	}
+	for t := range ret {
+		if len(primary_keys[t]) == 0 {
+			delete(ret, t)
+		}
+	}
+	return ret
+}
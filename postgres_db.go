@@ -1,33 +1,136 @@
 package sqlclone
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+// the methods that *sql.DB and *sql.Tx have in common
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
 type postgresDB struct {
-	*sql.DB
+	queryer
+	schemas []string // schemas whose tables are considered, table names are qualified with the schema
+	logger  Logger   // logs the executed queries if set
+}
+
+// a postgresDB whose queries are executed within a transaction
+type postgresTx struct {
+	postgresDB
+	tx *sql.Tx
+	// set if the transaction was started by the caller, commit and rollback only
+	// release or roll back this savepoint then
+	outer_savepoint string
 }
 
 type database interface {
-	getRows(string, string, interface{}) ([]map[string]interface{}, error)
-	insertRow(string, []string, []interface{}, string) (int, error)
-	getTables() ([]string, error)
-	getReferences() (References, error)
-	getPrimaryKeys() (map[string][]string, error)
-	getDependencyOrder() ([]string, error)
+	getRows(context.Context, rowQuery) ([]map[string]interface{}, error)
+	insertRows(context.Context, string, []string, [][]interface{}, []string) ([][]interface{}, error)
+	getTables(context.Context) ([]string, error)
+	getReferences(context.Context) (References, error)
+	getPrimaryKeys(context.Context) (map[string][]string, error)
+	getGeneratedColumns(context.Context) (map[string][]string, error)
+	getColumns(context.Context) (map[string][]column, error)
+	getDependencyOrder(context.Context) ([]string, []TableReference, error)
+	updateRow(context.Context, string, []string, []interface{}, []string, []interface{}) error
+	resetSequences(context.Context, string, []string) error
+	begin(context.Context) (transaction, error)
+}
+
+// a database whose changes only become visible after commit and can be undone by rollback
+type transaction interface {
+	database
+	commit() error
+	rollback() error
+	savepoint(context.Context, string) error
+	releaseSavepoint(context.Context, string) error
+	rollbackToSavepoint(context.Context, string) error
+}
+
+// start a transaction. all queries of the returned transaction are executed within it.
+// the transaction is rolled back if the context is done before it is committed.
+// within a transaction of the caller, a savepoint is used instead
+func (db postgresDB) begin(ctx context.Context) (transaction, error) {
+	switch q := db.queryer.(type) {
+	case *sql.DB:
+		tx, err := q.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, fmt.Errorf("transaction could not be started: %w", err)
+		}
+		return postgresTx{postgresDB: postgresDB{queryer: tx, schemas: db.schemas, logger: db.logger}, tx: tx}, nil
+	case *sql.Tx:
+		tx := postgresTx{postgresDB: db, tx: q, outer_savepoint: "sqlclone_upload"}
+		if err := tx.exec(ctx, "SAVEPOINT "+pq.QuoteIdentifier(tx.outer_savepoint)); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+	return nil, fmt.Errorf("a transaction can't be started on %T", db.queryer)
+}
+
+func (db postgresTx) commit() error {
+	if db.outer_savepoint != "" {
+		return db.exec(context.Background(), "RELEASE SAVEPOINT "+pq.QuoteIdentifier(db.outer_savepoint))
+	}
+	if err := db.tx.Commit(); err != nil {
+		return fmt.Errorf("transaction could not be committed: %w", err)
+	}
+	return nil
+}
+
+func (db postgresTx) rollback() error {
+	if db.outer_savepoint != "" {
+		return db.exec(context.Background(), "ROLLBACK TO SAVEPOINT "+pq.QuoteIdentifier(db.outer_savepoint))
+	}
+	// a transaction whose context is done was already rolled back
+	if err := db.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return fmt.Errorf("transaction could not be rolled back: %w", err)
+	}
+	return nil
+}
+
+func (db postgresTx) savepoint(ctx context.Context, name string) error {
+	return db.exec(ctx, "SAVEPOINT "+pq.QuoteIdentifier(name))
+}
+
+func (db postgresTx) releaseSavepoint(ctx context.Context, name string) error {
+	return db.exec(ctx, "RELEASE SAVEPOINT "+pq.QuoteIdentifier(name))
+}
+
+func (db postgresTx) rollbackToSavepoint(ctx context.Context, name string) error {
+	return db.exec(ctx, "ROLLBACK TO SAVEPOINT "+pq.QuoteIdentifier(name))
+}
+
+func (db postgresTx) exec(ctx context.Context, query string) error {
+	db.debug(ctx, "executing statement", "query", query)
+	if _, err := db.tx.ExecContext(ctx, query); err != nil {
+		return &QueryError{Query: query, Err: err}
+	}
+	return nil
 }
 
 // get list of tables in the database
-func (db postgresDB) getTables() ([]string, error) {
+func (db postgresDB) getTables(ctx context.Context) ([]string, error) {
 	var query = "" +
-		"SELECT table_name  " +
+		"SELECT table_schema || '.' || table_name " +
 		"FROM information_schema.tables " +
-		"WHERE table_schema = 'public'"
+		"WHERE table_schema = ANY($1)"
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query, pq.Array(db.schemas))
 	if err != nil {
-		return nil, fmt.Errorf("query could not be executed: %q resulting in error: %q", query, err)
+		return nil, &QueryError{Query: query, Err: err}
 	}
 	defer rows.Close()
 
@@ -35,64 +138,76 @@ func (db postgresDB) getTables() ([]string, error) {
 	for rows.Next() {
 		var t string
 		if err := rows.Scan(&t); err != nil {
-			return nil, fmt.Errorf("error extracting table name from result set: %q", err)
+			return nil, fmt.Errorf("error extracting table name from result set: %w", err)
 		}
 		tables = append(tables, t)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
 	return tables, nil
 }
 
-// get all references from all tables
-func (db postgresDB) getReferences() (References, error) {
+// get all references from all tables.
+// columns of a multi-column foreign key are returned in the order of the constraint definition
+func (db postgresDB) getReferences(ctx context.Context) (References, error) {
 	var query = "" +
 		"SELECT " +
-		"conrelid::regclass table_name, " +
-		"a1.attname column_name, " +
-		"confrelid::regclass referenced_table, " +
-		"a2.attname referenced_column_name " +
-		"FROM (" +
-		"select conrelid::regclass, confrelid::regclass, col, fcol " +
-		"from pg_constraint, " +
-		"lateral unnest(conkey) col, " +
-		"lateral unnest(confkey) fcol " +
-		"where contype = 'f'" +
-		") s " +
-		"JOIN pg_attribute a1 ON a1.attrelid = conrelid AND a1.attnum = col " +
-		"JOIN pg_attribute a2 ON a2.attrelid = confrelid AND a2.attnum = fcol;"
-
-	rows, err := db.Query(query)
+		"c.conname constraint_name, " +
+		"n1.nspname || '.' || t1.relname table_name, " +
+		"array_agg(a1.attname ORDER BY k.n) column_names, " +
+		"n2.nspname || '.' || t2.relname referenced_table, " +
+		"array_agg(a2.attname ORDER BY k.n) referenced_column_names " +
+		"FROM pg_constraint c " +
+		"CROSS JOIN LATERAL unnest(c.conkey, c.confkey) WITH ORDINALITY AS k(col, fcol, n) " +
+		"JOIN pg_class t1 ON t1.oid = c.conrelid " +
+		"JOIN pg_namespace n1 ON n1.oid = t1.relnamespace " +
+		"JOIN pg_class t2 ON t2.oid = c.confrelid " +
+		"JOIN pg_namespace n2 ON n2.oid = t2.relnamespace " +
+		"JOIN pg_attribute a1 ON a1.attrelid = c.conrelid AND a1.attnum = k.col " +
+		"JOIN pg_attribute a2 ON a2.attrelid = c.confrelid AND a2.attnum = k.fcol " +
+		"WHERE c.contype = 'f' " +
+		"AND n1.nspname = ANY($1) " +
+		"GROUP BY c.oid, c.conname, n1.nspname, t1.relname, n2.nspname, t2.relname"
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(db.schemas))
 	if err != nil {
-		return nil, fmt.Errorf("query could not be executed: %q  resulting in error: %q", query, err)
+		return nil, &QueryError{Query: query, Err: err}
 	}
 	defer rows.Close()
 
 	references := make(References)
 	for rows.Next() {
-		var t, tc, rt, rtc string
-		if err := rows.Scan(&t, &tc, &rt, &rtc); err != nil {
-			return nil, fmt.Errorf("error extracting table reference from result set: %q", err)
+		var name, t, rt string
+		var tcs, rtcs []string
+		if err := rows.Scan(&name, &t, pq.Array(&tcs), &rt, pq.Array(&rtcs)); err != nil {
+			return nil, fmt.Errorf("error extracting table reference from result set: %w", err)
 		}
-		references[t] = append(references[t], TableReference{table_name: t, column_name: tc, referenced_table_name: rt, referenced_column_name: rtc})
+		references[t] = append(references[t], *NewCompositeTableReference(name, t, tcs, rt, rtcs))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Query: query, Err: err}
 	}
 	return references, nil
 }
 
 // get all tables that have primary keys and their primary keys
-func (db postgresDB) getPrimaryKeys() (map[string][]string, error) {
+func (db postgresDB) getPrimaryKeys(ctx context.Context) (map[string][]string, error) {
 	var query = "" +
-		"SELECT tc.table_name, kc.column_name " +
+		"SELECT tc.table_schema || '.' || tc.table_name, kc.column_name " +
 		"FROM " +
 		"information_schema.table_constraints tc, " +
 		"information_schema.key_column_usage kc " +
 		"WHERE " +
 		"tc.constraint_type = 'PRIMARY KEY' " +
-		"AND tc.table_schema = 'public' " +
+		"AND tc.table_schema = ANY($1) " +
 		"AND kc.table_name = tc.table_name and kc.table_schema = tc.table_schema " +
-		"AND kc.constraint_name = tc.constraint_name"
+		"AND kc.constraint_name = tc.constraint_name " +
+		"ORDER BY kc.ordinal_position"
 
-	rows, err := db.Query(query)
+	rows, err := db.QueryContext(ctx, query, pq.Array(db.schemas))
 	if err != nil {
-		return nil, fmt.Errorf("query could not be executed: %q resulting in error: %q", query, err)
+		return nil, &QueryError{Query: query, Err: err}
 	}
 	defer rows.Close()
 
@@ -100,39 +215,154 @@ func (db postgresDB) getPrimaryKeys() (map[string][]string, error) {
 	for rows.Next() {
 		var t, c string
 		if err := rows.Scan(&t, &c); err != nil {
-			return nil, fmt.Errorf("error extracting primary key from result set: %q", err)
+			return nil, fmt.Errorf("error extracting primary key from result set: %w", err)
 		}
 		primary_keys[t] = append(primary_keys[t], c)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
 	return primary_keys, nil
 }
 
+// get all columns whose value is generated by the database if it is left out of an insert,
+// i.e. identity columns, serial columns and columns with a default value
+func (db postgresDB) getGeneratedColumns(ctx context.Context) (map[string][]string, error) {
+	var query = "" +
+		"SELECT n.nspname || '.' || c.relname table_name, a.attname column_name " +
+		"FROM pg_attribute a " +
+		"JOIN pg_class c ON c.oid = a.attrelid " +
+		"JOIN pg_namespace n ON n.oid = c.relnamespace " +
+		"LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum " +
+		"WHERE n.nspname = ANY($1) " +
+		"AND c.relkind IN ('r', 'p') " +
+		"AND a.attnum > 0 AND NOT a.attisdropped " +
+		"AND (a.attidentity <> '' OR d.oid IS NOT NULL)"
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(db.schemas))
+	if err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+	defer rows.Close()
+
+	generated_columns := make(map[string][]string, 0)
+	for rows.Next() {
+		var t, c string
+		if err := rows.Scan(&t, &c); err != nil {
+			return nil, fmt.Errorf("error extracting generated column from result set: %w", err)
+		}
+		generated_columns[t] = append(generated_columns[t], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+	return generated_columns, nil
+}
+
+// a column of a table in the database
+type column struct {
+	name      string
+	data_type string
+	nullable  bool
+}
+
+// get the columns of all tables in the order of their definition
+func (db postgresDB) getColumns(ctx context.Context) (map[string][]column, error) {
+	var query = "" +
+		"SELECT n.nspname || '.' || c.relname table_name, a.attname column_name, " +
+		"format_type(a.atttypid, a.atttypmod) data_type, NOT a.attnotnull nullable " +
+		"FROM pg_attribute a " +
+		"JOIN pg_class c ON c.oid = a.attrelid " +
+		"JOIN pg_namespace n ON n.oid = c.relnamespace " +
+		"WHERE n.nspname = ANY($1) " +
+		"AND c.relkind IN ('r', 'p') " +
+		"AND a.attnum > 0 AND NOT a.attisdropped " +
+		"ORDER BY a.attnum"
+
+	rows, err := db.QueryContext(ctx, query, pq.Array(db.schemas))
+	if err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+	defer rows.Close()
+
+	columns := make(map[string][]column, 0)
+	for rows.Next() {
+		var t string
+		var c column
+		if err := rows.Scan(&t, &c.name, &c.data_type, &c.nullable); err != nil {
+			return nil, fmt.Errorf("error extracting column from result set: %w", err)
+		}
+		columns[t] = append(columns[t], c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Query: query, Err: err}
+	}
+	return columns, nil
+}
+
 // returns the list of tables after a topological sort following Kahn's algorithm.
 // this list will be used to perform cloning so that data is inserted into the target database
-// before it is needed by referencing rows later on
-func (db postgresDB) getDependencyOrder() ([]string, error) {
-	references, err := db.getReferences()
+// before it is needed by referencing rows later on. cycles of references between tables are
+// broken by deferring references, which are returned as well
+func (db postgresDB) getDependencyOrder(ctx context.Context) ([]string, []TableReference, error) {
+	references, err := db.getReferences(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	tables, err := db.getTables()
+	tables, err := db.getTables(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	columns, err := db.getColumns(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dependencyOrder(tables, references, columns)
+}
+
+// topological sort of tables, so that referenced tables come first. a cycle of references
+// is broken at a reference whose columns are all nullable. such a deferred reference is
+// inserted as NULL first and updated once the referenced rows exist.
+// returns a *CycleError if a cycle contains no such reference
+func dependencyOrder(tables []string, references References, columns map[string][]column) ([]string, []TableReference, error) {
+	deferred := make([]TableReference, 0)
+	for {
+		order := sortTables(tables, references, deferred)
+		if len(order) == len(tables) {
+			return order, deferred, nil
+		}
+
+		rest := make([]string, 0)
+		for _, t := range tables {
+			if !sliceContains(order, t) {
+				rest = append(rest, t)
+			}
+		}
+		d, ok := cycleBreak(rest, references, columns, deferred)
+		if !ok {
+			return nil, nil, &CycleError{Tables: cycleTables(rest, references, deferred)}
+		}
+		deferred = append(deferred, d)
+	}
+}
+
+// topological sort of tables following Kahn's algorithm. references of a table to itself,
+// to tables that aren't sorted and deferred references are ignored. tables that are part of
+// a cycle or depend on one are left out
+func sortTables(tables []string, references References, deferred []TableReference) []string {
 	visited := make([]string, 0)
 	order := make([]string, 0)
 	S := make([]string, 0)
 	out_degrees := make(map[string]int, 0)
 
 	for _, table := range tables {
-		ref_tables := getReferencesFromTable(references, table)
-		out_degrees[table] = len(ref_tables)
-
-		self_referencing, _ := isTableSelfReferencing(references, table)
-		if self_referencing {
-			out_degrees[table]--
+		for _, r := range getReferencesFromTable(references, table) {
+			if isDependency(r, tables, deferred) {
+				out_degrees[table]++
+			}
 		}
 
 		if out_degrees[table] == 0 {
@@ -148,6 +378,9 @@ func (db postgresDB) getDependencyOrder() ([]string, error) {
 		S = S[:len(S)-1] // remove table from S
 		edges := getReferencesToTable(references, table)
 		for _, r := range edges {
+			if !isDependency(r, tables, deferred) {
+				continue
+			}
 			out_degrees[r.table_name]--
 			if out_degrees[r.table_name] == 0 && !sliceContains(visited, r.table_name) {
 				S = append(S, r.table_name)
@@ -155,95 +388,576 @@ func (db postgresDB) getDependencyOrder() ([]string, error) {
 		}
 	}
 
-	return order, nil
+	return order
 }
 
-// get rows from a table where a column has a certain value
-func (db postgresDB) getRows(table_name string, col string, val interface{}) ([]map[string]interface{}, error) {
+// whether a reference requires the referenced table to be sorted before the referencing one
+func isDependency(r TableReference, tables []string, deferred []TableReference) bool {
+	return r.table_name != r.referenced_table_name && sliceContains(tables, r.referenced_table_name) &&
+		!containsReference(deferred, r)
+}
+
+// find a reference within a cycle of the remaining tables whose columns are all nullable.
+// references are tried in the order of their tables and columns, so that the result is stable
+func cycleBreak(rest []string, references References, columns map[string][]column, deferred []TableReference) (TableReference, bool) {
+	candidates := make([]TableReference, 0)
+	for _, t := range rest {
+		for _, r := range getReferencesFromTable(references, t) {
+			if isDependency(r, rest, deferred) && nullableColumns(columns[t], r.column_names) &&
+				reaches(r.referenced_table_name, t, rest, references, deferred) {
+				candidates = append(candidates, r)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return TableReference{}, false
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].String() < candidates[j].String()
+	})
+	return candidates[0], true
+}
+
+// get the tables that are part of a cycle
+func cycleTables(rest []string, references References, deferred []TableReference) []string {
+	ret := make([]string, 0)
+	for _, t := range rest {
+		for _, r := range getReferencesFromTable(references, t) {
+			if isDependency(r, rest, deferred) && reaches(r.referenced_table_name, t, rest, references, deferred) {
+				ret = append(ret, t)
+				break
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// whether a table can be reached from another one by following references
+func reaches(from string, to string, tables []string, references References, deferred []TableReference) bool {
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if t == to {
+			return true
+		}
+		for _, r := range getReferencesFromTable(references, t) {
+			if isDependency(r, tables, deferred) && !seen[r.referenced_table_name] {
+				seen[r.referenced_table_name] = true
+				queue = append(queue, r.referenced_table_name)
+			}
+		}
+	}
+	return false
+}
+
+// whether all of the given columns are nullable. columns that are unknown are not nullable
+func nullableColumns(columns []column, names []string) bool {
+	for _, n := range names {
+		nullable := false
+		for _, c := range columns {
+			if c.name == n {
+				nullable = c.nullable
+			}
+		}
+		if !nullable {
+			return false
+		}
+	}
+	return true
+}
+
+func containsReference(references []TableReference, r TableReference) bool {
+	for _, d := range references {
+		if d.constraint_name == r.constraint_name && d.table_name == r.table_name &&
+			sameColumns(d.column_names, r.column_names) && d.referenced_table_name == r.referenced_table_name {
+			return true
+		}
+	}
+	return false
+}
+
+// dependency order of tables that also contains the tables of cycles that can't be broken.
+// these are appended in alphabetical order
+func dependencyOrderOfAll(tables []string, references References, columns map[string][]column) []string {
+	order, _, err := dependencyOrder(tables, references, columns)
+	if err == nil {
+		return order
+	}
+	order = sortTables(tables, references, nil)
+	rest := make([]string, 0)
+	for _, t := range tables {
+		if !sliceContains(order, t) {
+			rest = append(rest, t)
+		}
+	}
+	sort.Strings(rest)
+	return append(order, rest...)
+}
+
+// maximum number of value tuples that are looked up by a single query
+const batch_size = 1000
+
+// a query for all rows of a table whose columns match one of the given value tuples
+// and that fulfill all filters
+type rowQuery struct {
+	table_name string
+	columns    []string
+	values     [][]interface{}
+	filters    []rowFilter
+	// the columns of the rows to get, all columns if empty
+	projection []string
+}
+
+// an SQL predicate that rows of a table have to fulfill. the predicate refers to
+// its arguments as $1, $2, ...
+type rowFilter struct {
+	table     string
+	predicate string
+	args      []interface{}
+}
+
+// get rows from a table where the given columns have one of the given value tuples.
+// tuples that contain a NULL value are skipped, as such a value can't be matched
+func (db postgresDB) getRows(ctx context.Context, q rowQuery) ([]map[string]interface{}, error) {
 	ret := make([]map[string]interface{}, 0)
 
-	if val != nil {
-		query := "SELECT * FROM " + table_name + " WHERE \"" + col + "\"=" + fmt.Sprintf("%v", val)
-		//fmt.Println(query)
-		rows, err := db.Query("SELECT * FROM "+table_name+" WHERE \""+col+"\" = $1", val)
+	values := make([][]interface{}, 0, len(q.values))
+	for _, tuple := range q.values {
+		if !containsNil(tuple) {
+			values = append(values, tuple)
+		}
+	}
+
+	for start := 0; start < len(values); start += batch_size {
+		end := start + batch_size
+		if end > len(values) {
+			end = len(values)
+		}
+		rows, err := db.getRowBatch(ctx, q.table_name, q.projection, q.columns, values[start:end], q.filters)
 		if err != nil {
-			return nil, fmt.Errorf("query could not be executed: %q resulting in error: %q", query, err)
+			return nil, err
 		}
-		defer rows.Close()
+		ret = append(ret, rows...)
+	}
+	return ret, nil
+}
+
+// get rows from a table with a single query
+func (db postgresDB) getRowBatch(ctx context.Context, table_name string, projection []string, cols []string, values [][]interface{}, filters []rowFilter) ([]map[string]interface{}, error) {
+	query, args := selectQuery(table_name, projection, cols, values, filters)
+	column := strings.Join(cols, ", ")
+
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: table_name, Column: column, Query: query, Err: err}
+	}
+	defer rows.Close()
 
-		cols, _ := rows.Columns()
-		for rows.Next() {
-			colVals := make([]interface{}, len(cols))
-			for i := range colVals {
-				colVals[i] = new(interface{})
+	ret := make([]map[string]interface{}, 0)
+	cols, _ = rows.Columns()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, fmt.Errorf("error extracting column types from result set: %w", err)
+	}
+	for rows.Next() {
+		colVals := make([]interface{}, len(cols))
+		for i := range colVals {
+			colVals[i] = new(interface{})
+		}
+		err = rows.Scan(colVals...)
+		if err != nil {
+			return nil, fmt.Errorf("error extracting column values from result set: %w", err)
+		}
+		colNames, err := rows.Columns()
+		if err != nil {
+			return nil, fmt.Errorf("error extracting column names from result set: %w", err)
+		}
+		these := make(map[string]interface{})
+		for idx, name := range colNames {
+			these[name] = *colVals[idx].(*interface{})
+			// the driver returns the text representation of types like numeric or uuid as []byte,
+			// only values of bytea columns are kept as []byte
+			if b, ok := these[name].([]byte); ok {
+				these[name] = textValue(types[idx].DatabaseTypeName(), b)
 			}
-			err = rows.Scan(colVals...)
-			if err != nil {
-				return nil, fmt.Errorf("error extracting column values from result set: %q", err)
+		}
+		ret = append(ret, these)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &QueryError{Table: table_name, Column: column, Query: query, Err: err}
+	}
+	db.debug(ctx, "queried rows", "table", table_name, "query", query, "rows", len(ret), "duration", time.Since(start))
+	return ret, nil
+}
+
+// build a query for the rows of a table where the columns have one of the given value tuples.
+// a single column is compared with = ANY($1), multiple columns are compared as a row with a
+// list of value tuples. the predicates of the filters are added with renumbered arguments.
+// only the projected columns are selected, all columns if there are none
+func selectQuery(table_name string, projection []string, cols []string, values [][]interface{}, filters []rowFilter) (string, []interface{}) {
+	selected := "*"
+	if len(projection) > 0 {
+		quoted := make([]string, len(projection))
+		for i, col := range projection {
+			quoted[i] = pq.QuoteIdentifier(col)
+		}
+		selected = strings.Join(quoted, ", ")
+	}
+
+	var query string
+	var args []interface{}
+	if len(cols) == 1 {
+		list := make([]interface{}, len(values))
+		bytea := make(pq.ByteaArray, 0)
+		for i, tuple := range values {
+			list[i] = tuple[0]
+			if b, ok := tuple[0].([]byte); ok {
+				bytea = append(bytea, b)
 			}
-			colNames, err := rows.Columns()
-			if err != nil {
-				return nil, fmt.Errorf("error extracting column names from result set: %q", err)
+		}
+		query = "SELECT " + selected + " FROM " + quoteTable(table_name) + " WHERE " + pq.QuoteIdentifier(cols[0]) + " = ANY($1)"
+		args = []interface{}{pq.Array(list)}
+		if len(bytea) == len(list) {
+			// a generic array would send the bytes as text instead of bytea
+			args = []interface{}{bytea}
+		}
+	} else {
+		quoted := make([]string, len(cols))
+		for i, col := range cols {
+			quoted[i] = pq.QuoteIdentifier(col)
+		}
+		tuples := make([]string, len(values))
+		for i, tuple := range values {
+			placeholders := make([]string, len(tuple))
+			for j, v := range tuple {
+				args = append(args, v)
+				placeholders[j] = fmt.Sprintf("$%d", len(args))
 			}
-			these := make(map[string]interface{})
-			for idx, name := range colNames {
-				these[name] = *colVals[idx].(*interface{})
+			tuples[i] = "(" + strings.Join(placeholders, ", ") + ")"
+		}
+		query = "SELECT " + selected + " FROM " + quoteTable(table_name) + " WHERE (" + strings.Join(quoted, ", ") + ") IN (" + strings.Join(tuples, ", ") + ")"
+	}
+
+	for _, f := range filters {
+		query += " AND (" + renumberPlaceholders(f.predicate, len(args)) + ")"
+		args = append(args, f.args...)
+	}
+	return query, args
+}
+
+// shift the numbers of all $n placeholders in a predicate by offset.
+// placeholders within string literals and quoted identifiers are left untouched
+func renumberPlaceholders(predicate string, offset int) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(predicate); i++ {
+		c := predicate[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$' && i+1 < len(predicate) && predicate[i+1] >= '0' && predicate[i+1] <= '9':
+			j := i + 1
+			for j < len(predicate) && predicate[j] >= '0' && predicate[j] <= '9' {
+				j++
 			}
-			ret = append(ret, these)
+			n, _ := strconv.Atoi(predicate[i+1 : j])
+			b.WriteString("$" + strconv.Itoa(n+offset))
+			i = j - 1
+			continue
 		}
+		b.WriteByte(c)
 	}
-	return ret, nil
+	return b.String()
 }
 
-// insert a row with given column names and values into a database.
-// if the table has a column with an automatically generated value,
-// return that value after insertion, return -1 otherwise
-func (db postgresDB) insertRow(table_name string, columns []string, values []interface{}, primary_key string) (int, error) {
-	cols := ""
-	vals := ""
-	counter := 1
-	for _, c := range columns {
-		if c != primary_key {
-			cols += "\"" + c + "\", "
-			vals += "$" + fmt.Sprintf("%d", counter) + ", "
-			counter++
+// insert rows with given column names and values into a database.
+// the values of the returning columns, which are generated by the database, are returned
+// per row in the order of the rows. postgres doesn't guarantee the order of the rows returned
+// by a multi-row insert, so the generated values are reserved from the sequences of the
+// returning columns and inserted with the rows. rows with returning columns that have no
+// sequence, e.g. a uuid with a default value, are inserted one by one.
+// rows are inserted with COPY if there are no returning columns or their values are reserved
+func (db postgresDB) insertRows(ctx context.Context, table_name string, columns []string, rows [][]interface{}, returning []string) ([][]interface{}, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	if len(returning) == 0 && len(columns) > 0 {
+		return nil, db.copyRows(ctx, table_name, columns, rows)
+	}
+
+	generated, err := db.nextValues(ctx, table_name, returning, len(rows))
+	if err != nil {
+		return nil, err
+	}
+	if generated != nil {
+		all_columns := append(append(make([]string, 0, len(columns)+len(returning)), columns...), returning...)
+		all_rows := make([][]interface{}, len(rows))
+		for i, row := range rows {
+			all_rows[i] = append(append(make([]interface{}, 0, len(all_columns)), row...), generated[i]...)
+		}
+		// COPY writes the values of identity columns like INSERT with OVERRIDING SYSTEM VALUE
+		if err := db.copyRows(ctx, table_name, all_columns, all_rows); err != nil {
+			return nil, err
+		}
+		return generated, nil
+	}
+
+	ret := make([][]interface{}, 0, len(rows))
+	for _, row := range rows {
+		new_values, err := db.insertBatch(ctx, table_name, columns, [][]interface{}{row}, returning)
+		if err != nil {
+			return nil, err
 		}
+		ret = append(ret, new_values...)
 	}
-	cols = cols[:len(cols)-2]
-	vals = vals[:len(vals)-2]
+	return ret, nil
+}
 
-	query := "INSERT INTO " + table_name + " (" + cols + ") VALUES (" + vals + ")"
+// reserve n values of each column from the sequence that owns the column. returns nil
+// if one of the columns has no sequence
+func (db postgresDB) nextValues(ctx context.Context, table_name string, columns []string, n int) ([][]interface{}, error) {
+	ret := make([][]interface{}, n)
+	for i := range ret {
+		ret[i] = make([]interface{}, len(columns))
+	}
 
-	lastInsertId := -1
-	if primary_key != "" {
-		query += " RETURNING " + primary_key
-		//fmt.Println(query)
-		//fmt.Println(values)
-		err := db.QueryRow(query, values...).Scan(&lastInsertId)
+	for j, c := range columns {
+		sequence, exists, err := db.serialSequence(ctx, table_name, c)
 		if err != nil {
-			return -1, fmt.Errorf("insertion could not be executed for: %q resulting in error: %q", query, err)
+			return nil, err
+		}
+		if !exists {
+			return nil, nil
+		}
+
+		query := "SELECT nextval($1) FROM generate_series(1, $2)"
+		rows, err := db.QueryContext(ctx, query, sequence, n)
+		if err != nil {
+			return nil, &QueryError{Table: table_name, Column: c, Query: query, Err: err}
+		}
+		i := 0
+		for rows.Next() && i < n {
+			var v int64
+			if err := rows.Scan(&v); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("error extracting reserved value from result set: %w", err)
+			}
+			ret[i][j] = v
+			i++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, &QueryError{Table: table_name, Column: c, Query: query, Err: err}
+		}
+		if i != n {
+			return nil, &QueryError{Table: table_name, Column: c, Query: query, Err: fmt.Errorf("reserved %d values instead of %d", i, n)}
 		}
+	}
+	return ret, nil
+}
+
+// get the sequence that owns a column, e.g. of a serial or identity column
+func (db postgresDB) serialSequence(ctx context.Context, table_name string, column string) (string, bool, error) {
+	var sequence sql.NullString
+	query := "SELECT pg_get_serial_sequence($1, $2)"
+	if err := db.QueryRowContext(ctx, query, quoteTable(table_name), column).Scan(&sequence); err != nil {
+		return "", false, &QueryError{Table: table_name, Column: column, Query: query, Err: err}
+	}
+	return sequence.String, sequence.Valid, nil
+}
+
+// insert rows with a single statement and return the values of the returning columns.
+// only used for single rows, as the returned rows of a multi-row insert may be in any order
+func (db postgresDB) insertBatch(ctx context.Context, table_name string, columns []string, rows [][]interface{}, returning []string) ([][]interface{}, error) {
+	cols := make([]string, len(columns))
+	for i, c := range columns {
+		cols[i] = pq.QuoteIdentifier(c)
+	}
 
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	tuples := make([]string, len(rows))
+	for i, row := range rows {
+		placeholders := make([]string, len(row))
+		for j, v := range row {
+			args = append(args, v)
+			placeholders[j] = fmt.Sprintf("$%d", len(args))
+		}
+		tuples[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	query := "INSERT INTO " + quoteTable(table_name) + " (" + strings.Join(cols, ", ") + ") VALUES " + strings.Join(tuples, ", ")
+	if len(columns) == 0 {
+		query = "INSERT INTO " + quoteTable(table_name) + " DEFAULT VALUES"
+	}
+
+	ret_cols := make([]string, len(returning))
+	for i, c := range returning {
+		ret_cols[i] = pq.QuoteIdentifier(c)
+	}
+	query += " RETURNING " + strings.Join(ret_cols, ", ")
+
+	start := time.Now()
+	result, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, &QueryError{Table: table_name, Query: query, Err: err}
+	}
+	defer result.Close()
+
+	ret := make([][]interface{}, 0, len(rows))
+	for result.Next() {
+		new_values := make([]interface{}, len(returning))
+		dest := make([]interface{}, len(returning))
+		for i := range dest {
+			dest[i] = &new_values[i]
+		}
+		if err := result.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("error extracting generated values from result set: %w", err)
+		}
+		ret = append(ret, new_values)
+	}
+	if err := result.Err(); err != nil {
+		return nil, &QueryError{Table: table_name, Query: query, Err: err}
+	}
+	if len(ret) != len(rows) {
+		return nil, &QueryError{Table: table_name, Query: query, Err: fmt.Errorf("returned %d rows instead of %d", len(ret), len(rows))}
+	}
+	db.debug(ctx, "inserted rows", "table", table_name, "query", query, "rows", len(ret), "duration", time.Since(start))
+	return ret, nil
+}
+
+// insert rows with COPY FROM STDIN. this only works within a transaction
+func (db postgresDB) copyRows(ctx context.Context, table_name string, columns []string, rows [][]interface{}) error {
+	parts := strings.SplitN(table_name, ".", 2)
+	var query string
+	if len(parts) == 2 {
+		query = pq.CopyInSchema(parts[0], parts[1], columns...)
 	} else {
-		//fmt.Println(query)
-		//fmt.Println(values)
-		_, err := db.Exec(query, values...)
+		query = pq.CopyIn(table_name, columns...)
+	}
+
+	start := time.Now()
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return &QueryError{Table: table_name, Query: query, Err: err}
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return &QueryError{Table: table_name, Query: query, Err: err}
+		}
+	}
+	// an Exec without arguments flushes the buffered rows
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return &QueryError{Table: table_name, Query: query, Err: err}
+	}
+	db.debug(ctx, "copied rows", "table", table_name, "query", query, "rows", len(rows), "duration", time.Since(start))
+	return nil
+}
+
+// set the sequences owned by the columns of a table, e.g. of serial and identity columns, so that
+// the next generated value is higher than all values of the column. columns without a sequence are skipped
+func (db postgresDB) resetSequences(ctx context.Context, table_name string, columns []string) error {
+	for _, c := range columns {
+		sequence, exists, err := db.serialSequence(ctx, table_name, c)
 		if err != nil {
-			return -1, fmt.Errorf("insertion could not be executed for: %q resulting in error: %q", query, err)
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		query := "SELECT setval($1, COALESCE(MAX(" + pq.QuoteIdentifier(c) + "), 0) + 1, false) FROM " + quoteTable(table_name)
+		if _, err := db.ExecContext(ctx, query, sequence); err != nil {
+			return &QueryError{Table: table_name, Column: c, Query: query, Err: err}
 		}
+		db.debug(ctx, "reset sequence", "table", table_name, "column", c, "sequence", sequence)
+	}
+	return nil
+}
+
+// update the set columns of the row of a table that is identified by the key columns
+func (db postgresDB) updateRow(ctx context.Context, table_name string, key_columns []string, key_values []interface{}, set_columns []string, set_values []interface{}) error {
+	args := make([]interface{}, 0, len(set_values)+len(key_values))
+	assignments := make([]string, len(set_columns))
+	for i, c := range set_columns {
+		args = append(args, set_values[i])
+		assignments[i] = fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(c), len(args))
+	}
+	conditions := make([]string, len(key_columns))
+	for i, c := range key_columns {
+		args = append(args, key_values[i])
+		conditions[i] = fmt.Sprintf("%s = $%d", pq.QuoteIdentifier(c), len(args))
+	}
+	query := "UPDATE " + quoteTable(table_name) + " SET " + strings.Join(assignments, ", ") + " WHERE " + strings.Join(conditions, " AND ")
+
+	start := time.Now()
+	result, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return &QueryError{Table: table_name, Query: query, Err: err}
 	}
+	if n, err := result.RowsAffected(); err == nil && n != 1 {
+		return &QueryError{Table: table_name, Query: query, Err: fmt.Errorf("affected %d rows instead of 1", n)}
+	}
+	db.debug(ctx, "updated row", "table", table_name, "query", query, "duration", time.Since(start))
+	return nil
+}
+
+// quote a table name that is qualified with its schema, e.g. billing.invoice becomes "billing"."invoice"
+func quoteTable(table_name string) string {
+	parts := strings.SplitN(table_name, ".", 2)
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
 
-	return lastInsertId, nil
+// convert the text representation of a value to a Go value that keeps its type
+func textValue(database_type string, b []byte) interface{} {
+	switch {
+	case database_type == "BYTEA":
+		return b
+	case database_type == "NUMERIC":
+		return Numeric(b)
+	case database_type == "UUID":
+		return UUID(b)
+	case database_type == "JSON" || database_type == "JSONB":
+		return JSON(b)
+	case strings.HasPrefix(database_type, "_"):
+		// names of array types start with an underscore
+		return Array(b)
+	}
+	return string(b)
 }
 
-func isTableSelfReferencing(references References, table_name string) (bool, string) {
-	from := getReferencesFromTable(references, table_name)
-	for _, d := range from {
+func containsNil(values []interface{}) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// get the references of a table to itself
+func selfReferences(references References, table_name string) []TableReference {
+	ret := make([]TableReference, 0)
+	for _, d := range getReferencesFromTable(references, table_name) {
 		if d.referenced_table_name == table_name {
-			return true, d.referenced_column_name
+			ret = append(ret, d)
 		}
 	}
-	return false, ""
+	return ret
 }
 
 func getReferencesToTable(references References, table_name string) []TableReference {
@@ -261,13 +975,3 @@ func getReferencesToTable(references References, table_name string) []TableRefer
 func getReferencesFromTable(references References, table_name string) []TableReference {
 	return references[table_name]
 }
-
-func getReference(input []TableReference, searchString string) (TableReference, bool) {
-	var ret TableReference
-	for _, d := range input {
-		if d.column_name == searchString {
-			return d, true
-		}
-	}
-	return ret, false
-}
@@ -0,0 +1,44 @@
+package sqlclone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Provenance describes why the rows of a DatabaseDump were included. the rows of each
+// table are at the same positions as in the DatabaseDump
+type Provenance map[string][]RowProvenance
+
+// RowProvenance describes how a row was reached from a starting point
+type RowProvenance struct {
+	// the starting point, e.g. "person.id = 1"
+	StartPoint string `json:"start_point"`
+	// the references that were followed from the starting point, in order.
+	// empty if the row is a starting point itself
+	References []TableReference `json:"references"`
+}
+
+// get the provenance of a row that was found by a lookup
+func newRowProvenance(l lookup) RowProvenance {
+	start := l.root()
+	conditions := make([]string, len(start.columns))
+	for i, c := range start.columns {
+		conditions[i] = fmt.Sprintf("%s = %v", c, start.values[i])
+	}
+	return RowProvenance{
+		StartPoint: start.table_name + "." + strings.Join(conditions, " AND "),
+		References: l.path(),
+	}
+}
+
+// formats the provenance as e.g. "person.id = 1: purchase.person_id -> person.id"
+func (p RowProvenance) String() string {
+	if len(p.References) == 0 {
+		return p.StartPoint
+	}
+	refs := make([]string, len(p.References))
+	for i, r := range p.References {
+		refs[i] = r.String()
+	}
+	return p.StartPoint + ": " + strings.Join(refs, ", ")
+}
@@ -0,0 +1,141 @@
+package sqlclone
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// sort the rows of a self-referencing table level by level, so that every row comes after the rows
+// it references. the rows of a level are sorted by their primary key. rows that are part of a cycle,
+// reference themselves or reference a row of a cycle can't be sorted this way, they are returned
+// separately, also sorted by their primary key
+func sortSelfReferencing(rows []map[string]interface{}, self_references []TableReference, primary_key []string) ([]map[string]interface{}, []map[string]interface{}) {
+	// positions of the rows by the values of the referenced columns
+	positions := make([]map[string][]int, len(self_references))
+	for i, r := range self_references {
+		positions[i] = make(map[string][]int)
+		for j, row := range rows {
+			key := canonicalTuple(rowValues(row, r.referenced_column_names))
+			positions[i][key] = append(positions[i][key], j)
+		}
+	}
+
+	in_degrees := make([]int, len(rows))
+	children := make([][]int, len(rows))
+	for j, row := range rows {
+		parents := make(map[int]bool)
+		for i, r := range self_references {
+			vals := rowValues(row, r.column_names)
+			if containsNil(vals) {
+				continue
+			}
+			for _, p := range positions[i][canonicalTuple(vals)] {
+				parents[p] = true
+			}
+		}
+		in_degrees[j] = len(parents)
+		for p := range parents {
+			children[p] = append(children[p], j)
+		}
+	}
+
+	level := make([]int, 0)
+	for j := range rows {
+		if in_degrees[j] == 0 {
+			level = append(level, j)
+		}
+	}
+
+	sorted := make([]map[string]interface{}, 0, len(rows))
+	done := make([]bool, len(rows))
+	for len(level) > 0 {
+		sortByKey(rows, level, primary_key)
+		next := make([]int, 0)
+		for _, j := range level {
+			sorted = append(sorted, rows[j])
+			done[j] = true
+			for _, c := range children[j] {
+				in_degrees[c]--
+				if in_degrees[c] == 0 {
+					next = append(next, c)
+				}
+			}
+		}
+		level = next
+	}
+
+	rest := make([]int, 0)
+	for j := range rows {
+		if !done[j] {
+			rest = append(rest, j)
+		}
+	}
+	sortByKey(rows, rest, primary_key)
+	cyclic := make([]map[string]interface{}, len(rest))
+	for i, j := range rest {
+		cyclic[i] = rows[j]
+	}
+	return sorted, cyclic
+}
+
+// sort positions of rows by the primary key of the rows, keeping their order without one
+func sortByKey(rows []map[string]interface{}, positions []int, primary_key []string) {
+	sort.SliceStable(positions, func(a, b int) bool {
+		for _, c := range primary_key {
+			if cmp := compareValues(rows[positions[a]][c], rows[positions[b]][c]); cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+}
+
+// compare two values, numbers by their value and all other values by their text.
+// NULL comes first
+func compareValues(a interface{}, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		}
+		return 1
+	}
+
+	if x, ok := numberValue(a); ok {
+		if y, ok := numberValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	x, y := fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// get the value of a number of any kind
+func numberValue(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
@@ -1,16 +1,21 @@
 package sqlclone
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"reflect"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
 type References map[string][]TableReference
+
+// rows per table. when encoded as JSON, every value keeps its type, see typedValue
 type DatabaseDump map[string][]map[string]interface{}
 type Mapping map[string]map[string]string
 
@@ -20,171 +25,863 @@ type Mapping map[string]map[string]string
 // from the source database as specified in the connection parameters.
 // returns the collected data as a DatabaseDump of the structure: map[string][]map[string]interface{}
 func Download(cp *ConnectionParameters, options *downloadOptions) (DatabaseDump, error) {
-	from_db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cp.host, cp.port, cp.user, cp.password, cp.dbname))
+	return DownloadContext(context.Background(), cp, options)
+}
+
+// Download that stops querying the source database once the context is done
+func DownloadContext(ctx context.Context, cp *ConnectionParameters, options *downloadOptions) (DatabaseDump, error) {
+	from_db, err := cp.open()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer from_db.Close()
 
-	return download(postgresDB{from_db}, options)
+	return DownloadDB(ctx, from_db, options)
 }
 
-func download(db database, options *downloadOptions) (DatabaseDump, error) {
-	references, err := db.getReferences()
+// Download from a connection pool of the caller, which is left open
+func DownloadDB(ctx context.Context, db *sql.DB, options *downloadOptions) (DatabaseDump, error) {
+	return download(ctx, postgresDB{queryer: db, schemas: options.schemas, logger: options.logger}, options)
+}
+
+// Download within a transaction of the caller, e.g. to read from a consistent snapshot.
+// the transaction is neither committed nor rolled back
+func DownloadTx(ctx context.Context, tx *sql.Tx, options *downloadOptions) (DatabaseDump, error) {
+	return download(ctx, postgresDB{queryer: tx, schemas: options.schemas, logger: options.logger}, options)
+}
+
+func download(ctx context.Context, db database, options *downloadOptions) (DatabaseDump, error) {
+	w, start, err := newDownloadWalker(ctx, db, options)
 	if err != nil {
 		return nil, err
 	}
+	if err := w.walk(ctx, start); err != nil {
+		return nil, err
+	}
+	return w.dump, nil
+}
+
+// get a graph walker for the source database and the lookups of the starting points
+func newDownloadWalker(ctx context.Context, db database, options *downloadOptions) (*graphWalker, []lookup, error) {
+	references, err := db.getReferences(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tables, err := db.getTables(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	primary_keys, err := db.getPrimaryKeys(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolved := options.resolve(tables)
 
-	database_dump := make(DatabaseDump)
-	for _, sp := range options.start_points {
-		database_dump, err = getDataRecursively(db, references, database_dump, options.dont_recurse, sp.table, sp.column, sp.value)
+	start := make([]lookup, len(resolved.start_points))
+	for i, sp := range resolved.start_points {
+		start[i] = lookup{table_name: sp.table, columns: []string{sp.column}, values: []interface{}{sp.value}}
 	}
-	return database_dump, err
+
+	return newGraphWalker(db, references, primary_keys, resolved), start, nil
 }
 
 // inserts all downloaded rows in the DatabaseDump into the target database as specified in the connection parameters.
+// all rows are inserted within a single transaction, if one of them fails nothing is inserted at all.
 // returns a map of the structure map[string]map[string]string that shows which identifiers in the source database
 // correspond to which identifiers in the target database
-func Upload(cp *ConnectionParameters, data DatabaseDump) (Mapping, error) {
-	to_db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		cp.host, cp.port, cp.user, cp.password, cp.dbname))
+func Upload(cp *ConnectionParameters, data DatabaseDump, opts ...UploadOption) (Mapping, error) {
+	return UploadContext(context.Background(), cp, data, opts...)
+}
+
+// Upload that stops once the context is done. the transaction is rolled back in that
+// case, so that nothing is inserted into the target database
+func UploadContext(ctx context.Context, cp *ConnectionParameters, data DatabaseDump, opts ...UploadOption) (Mapping, error) {
+	to_db, err := cp.open()
 	if err != nil {
 		return nil, err
 	}
 	defer to_db.Close()
 
-	return upload(postgresDB{to_db}, data)
+	return UploadDB(ctx, to_db, data, opts...)
+}
+
+// Upload into a connection pool of the caller, which is left open
+func UploadDB(ctx context.Context, db *sql.DB, data DatabaseDump, opts ...UploadOption) (Mapping, error) {
+	options := newUploadOptions(opts...)
+	return upload(ctx, postgresDB{queryer: db, schemas: dumpSchemas(data), logger: options.logger}, data, options)
+}
+
+// Upload within a transaction of the caller, which is neither committed nor rolled back.
+// the rows are inserted within a savepoint instead, which is rolled back if the upload fails
+func UploadTx(ctx context.Context, tx *sql.Tx, data DatabaseDump, opts ...UploadOption) (Mapping, error) {
+	options := newUploadOptions(opts...)
+	return upload(ctx, postgresDB{queryer: tx, schemas: dumpSchemas(data), logger: options.logger}, data, options)
+}
+
+// reads the schema of the tables in the given schemas of a database, as written to the header of a dump file.
+// defaults to the public schema
+func ReadSchema(cp *ConnectionParameters, schemas ...string) (*Schema, error) {
+	return ReadSchemaContext(context.Background(), cp, schemas...)
 }
 
-func upload(db database, data DatabaseDump) (Mapping, error) {
-	order, err := db.getDependencyOrder()
+// ReadSchema that stops querying the database once the context is done
+func ReadSchemaContext(ctx context.Context, cp *ConnectionParameters, schemas ...string) (*Schema, error) {
+	db, err := cp.open()
 	if err != nil {
 		return nil, err
 	}
+	defer db.Close()
 
-	references, err := db.getReferences()
+	if len(schemas) == 0 {
+		schemas = []string{"public"}
+	}
+	return readSchema(ctx, postgresDB{queryer: db, schemas: schemas})
+}
+
+// inserts all rows of a dump file into the target database as specified in the connection parameters.
+// tables are uploaded one by one in the order of the file, without reading the whole file into memory,
+// unless the file has no schema. returns the same Mapping as Upload
+func UploadDump(cp *ConnectionParameters, r io.Reader, opts ...UploadOption) (Mapping, error) {
+	return UploadDumpContext(context.Background(), cp, r, opts...)
+}
+
+// UploadDump that stops once the context is done, rolling back the transaction
+func UploadDumpContext(ctx context.Context, cp *ConnectionParameters, r io.Reader, opts ...UploadOption) (Mapping, error) {
+	dr, err := NewDumpReader(r)
 	if err != nil {
 		return nil, err
 	}
 
-	primary_keys, err := db.getPrimaryKeys()
+	to_db, err := cp.open()
 	if err != nil {
 		return nil, err
 	}
+	defer to_db.Close()
 
-	mapping := make(Mapping)
+	options := newUploadOptions(opts...)
+	return uploadDump(ctx, func(schemas []string) database {
+		return postgresDB{queryer: to_db, schemas: schemas, logger: options.logger}
+	}, dr, options)
+}
+
+func upload(ctx context.Context, db database, dump DatabaseDump, options *uploadOptions) (Mapping, error) {
+	return runUpload(ctx, db, options, func(u *uploader) error {
+		// dumps may contain table names without a schema
+		data := make(DatabaseDump, len(dump))
+		for t, rows := range dump {
+			resolved := resolveTable(u.tables, []string{"public"}, t)
+			if len(rows) > 0 && !sliceContains(u.tables, resolved) {
+				return &SchemaMismatchError{Table: resolved}
+			}
+			data[resolved] = rows
+		}
+
+		for _, t := range u.order {
+			if len(data[t]) == 0 {
+				continue
+			}
+			if err := u.uploadTable(ctx, t, data[t]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	for _, t := range order {
-		ok, c := isTableSelfReferencing(references, t)
-		if ok {
-			sort.Slice(data[t], func(i, j int) bool {
-				v1 := fmt.Sprintf("%v", data[t][i][c])
-				v2 := fmt.Sprintf("%v", data[t][j][c])
-				return v1 < v2
-			})
+// upload the tables of a dump file in the order in which they are read, so that only the rows
+// of a single table are held in memory. all tables have to be part of the schema of the dump,
+// which lists them in the order of their dependencies. a dump without a schema is read into
+// memory and uploaded in the order of the target database. target returns the target
+// database, reading the tables of the given schemas
+func uploadDump(ctx context.Context, target func(schemas []string) database, dr *DumpReader, options *uploadOptions) (Mapping, error) {
+	if len(dr.Schema().Tables) == 0 {
+		// without a schema, the schemas of the target database to read and the order of the
+		// tables are only known after reading all tables
+		data, err := dr.readAll()
+		if err != nil {
+			return nil, err
 		}
-		for _, r := range data[t] {
-			mapping, err = uploadRow(db, primary_keys, references, mapping, t, r)
+		return upload(ctx, target(dumpSchemas(data)), data, options)
+	}
+
+	return runUpload(ctx, target(tableSchemas(dr.Schema().tableNames())), options, func(u *uploader) error {
+		for {
+			t, rows, err := dr.NextTable()
+			if err == io.EOF {
+				return nil
+			}
 			if err != nil {
-				return mapping, err
+				return err
+			}
+			if dr.Schema().table(t) == nil {
+				return fmt.Errorf("table %q of the dump file is not part of its schema", t)
+			}
+			if err := u.uploadTable(ctx, resolveTable(u.tables, []string{"public"}, t), rows); err != nil {
+				return err
 			}
 		}
+	})
+}
+
+// run an upload within a transaction. the deferred references are updated after upload_tables
+// has inserted all rows, and the sequences are reset if primary keys were preserved.
+// the transaction is committed if that succeeds and rolled back otherwise
+func runUpload(ctx context.Context, db database, options *uploadOptions, upload_tables func(*uploader) error) (Mapping, error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return mapping, nil
+
+	u, err := newUploader(ctx, tx, options)
+	if err == nil {
+		err = upload_tables(u)
+	}
+	if err == nil {
+		err = u.updateDeferred(ctx)
+	}
+	if err == nil && options.preserve_keys {
+		err = u.resetSequences(ctx)
+	}
+	if err != nil {
+		if rollback_err := tx.rollback(); rollback_err != nil {
+			return nil, fmt.Errorf("%w, the upload could not be rolled back: %v", err, rollback_err)
+		}
+		return nil, fmt.Errorf("%w, the upload was rolled back", err)
+	}
+
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	if len(u.skipped) > 0 {
+		return nil, &SkippedTablesError{Tables: u.skipped, Errors: u.skipped_errors, Mapping: u.mapping}
+	}
+	return u.mapping, nil
+}
+
+// keeps track of the state of an upload into the target database
+type uploader struct {
+	db                transaction
+	options           *uploadOptions
+	tables            []string
+	primary_keys      map[string][]string
+	generated_columns map[string][]string
+	columns           map[string][]column
+	references        References
+	mapping           Mapping
+	// target primary key values per table, keyed by the mapping key of the source primary key values
+	new_keys map[string]map[string][]interface{}
+	// number of tables uploaded so far
+	table_count int
+	// the order in which tables are uploaded and the references that are updated after all
+	// rows were inserted, to break cycles between tables
+	order    []string
+	deferred []TableReference
+	updates  []deferredUpdate
+	// the tables that were rolled back to their savepoints and the errors by which they failed
+	skipped        []string
+	skipped_errors []error
 }
 
-func getDataRecursively(db database, references References, database_dump DatabaseDump, dont_recurse []string, table_name string, col string, val interface{}) (DatabaseDump, error) {
-	rows, err := db.getRows(table_name, col, val)
+// a row whose deferred references still have to be updated
+type deferredUpdate struct {
+	table_name string
+	// the position of the row in the dump
+	position int
+	// the primary key of the row in the target database
+	key []interface{}
+	// the row as it is in the dump
+	row map[string]interface{}
+	// the references that were inserted as NULL
+	references []TableReference
+}
+
+// Constructor function, reads the schema information of the target database
+func newUploader(ctx context.Context, db transaction, options *uploadOptions) (*uploader, error) {
+	tables, err := db.getTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	references, err := db.getReferences(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	primary_keys, err := db.getPrimaryKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	generated_columns, err := db.getGeneratedColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := db.getColumns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, deferred, err := db.getDependencyOrder(ctx)
 	if err != nil {
 		return nil, err
 	}
+
+	return &uploader{
+		db:                db,
+		options:           options,
+		tables:            tables,
+		primary_keys:      primary_keys,
+		generated_columns: generated_columns,
+		columns:           columns,
+		references:        references,
+		mapping:           make(Mapping),
+		new_keys:          make(map[string]map[string][]interface{}),
+		order:             order,
+		deferred:          deferred,
+	}, nil
+}
+
+// upload all rows of a table, within a savepoint if requested
+func (u *uploader) uploadTable(ctx context.Context, table_name string, rows []map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := u.checkSchema(table_name, rows); err != nil {
+		return err
+	}
+
+	// rows that can't be sorted before the rows referencing them are inserted last,
+	// their references to the same table are updated after all rows were inserted
+	self_references := selfReferences(u.references, table_name)
+	cyclic := make([]map[string]interface{}, 0)
+	if len(self_references) > 0 {
+		rows, cyclic = sortSelfReferencing(rows, self_references, u.primary_keys[table_name])
+	}
+	deferred := u.deferredReferences(table_name)
+
+	savepoint := fmt.Sprintf("sqlclone_table_%d", u.table_count)
+	u.table_count++
+	if u.options.savepoint_per_table {
+		if err := u.db.savepoint(ctx, savepoint); err != nil {
+			return err
+		}
+	}
+
+	// the state that is restored if the table is skipped
+	updates := len(u.updates)
+	var mapping map[string]string
+	var new_keys map[string][]interface{}
+	if u.options.savepoint_per_table {
+		mapping, new_keys = copyTableMapping(u.mapping[table_name]), copyTableKeys(u.new_keys[table_name])
+	}
+
+	err := u.uploadRows(ctx, table_name, rows, 0, deferred)
+	if err == nil && len(cyclic) > 0 {
+		err = u.uploadRows(ctx, table_name, cyclic, len(rows), append(deferred, self_references...))
+	}
+	if err != nil {
+		if !u.options.savepoint_per_table || ctx.Err() != nil {
+			return err
+		}
+		if sp_err := u.db.rollbackToSavepoint(ctx, savepoint); sp_err != nil {
+			return sp_err
+		}
+		u.updates = u.updates[:updates]
+		delete(u.mapping, table_name)
+		if mapping != nil {
+			u.mapping[table_name] = mapping
+		}
+		delete(u.new_keys, table_name)
+		if new_keys != nil {
+			u.new_keys[table_name] = new_keys
+		}
+		u.skipped = append(u.skipped, table_name)
+		u.skipped_errors = append(u.skipped_errors, err)
+		return nil
+	}
+
+	if u.options.savepoint_per_table {
+		return u.db.releaseSavepoint(ctx, savepoint)
+	}
+	return nil
+}
+
+// make sure that the table and all columns of its rows exist in the target database
+func (u *uploader) checkSchema(table_name string, rows []map[string]interface{}) error {
+	if !sliceContains(u.tables, table_name) {
+		return &SchemaMismatchError{Table: table_name}
+	}
+	columns, exists := u.columns[table_name]
+	if !exists {
+		return nil
+	}
 	for _, r := range rows {
-		if !dumpContainsRow(database_dump[table_name], r) {
-			database_dump[table_name] = append(database_dump[table_name], r)
-
-			var df = getReferencesFromTable(references, table_name)
-			for _, d := range df {
-				if !dumpContainsResultOfQuery(database_dump, d.referenced_table_name, d.referenced_column_name, r[d.column_name]) &&
-					!sliceContains(dont_recurse, d.referenced_table_name) {
-					getDataRecursively(db, references, database_dump, dont_recurse, d.referenced_table_name, d.referenced_column_name, r[d.column_name])
-				}
+		for c := range r {
+			if !hasColumn(columns, c) {
+				return &SchemaMismatchError{Table: table_name, Column: c}
 			}
+		}
+	}
+	return nil
+}
 
-			var dr = getReferencesToTable(references, table_name)
-			for _, d := range dr {
-				if !dumpContainsResultOfQuery(database_dump, d.table_name, d.column_name, val) &&
-					!sliceContains(dont_recurse, d.table_name) {
-					getDataRecursively(db, references, database_dump, dont_recurse, d.table_name, d.column_name, r[d.referenced_column_name])
-				}
+// insert the rows of a table into the target database in batches and update the mapping if necessary.
+// a batch ends before a row whose columns differ from the previous rows, or that references a row
+// of the same table within the batch, as the referenced row has to be inserted first.
+// offset is the position of the first row within the table, deferred are the references that are
+// inserted as NULL and updated later
+func (u *uploader) uploadRows(ctx context.Context, table_name string, data []map[string]interface{}, offset int, deferred []TableReference) error {
+	self_references := selfReferences(u.references, table_name)
+
+	start := 0
+	columns := ""
+	pending := make(lookupIndex)
+	for i, r := range data {
+		if i > start && (columnsKey(r) != columns || referencesPending(self_references, pending, r)) {
+			if err := u.uploadBatch(ctx, table_name, data[start:i], offset+start, deferred); err != nil {
+				return err
 			}
+			start = i
+			pending = make(lookupIndex)
+		}
+		columns = columnsKey(r)
+		for _, d := range self_references {
+			pending.add(table_name, d.referenced_column_names, rowValues(r, d.referenced_column_names))
 		}
 	}
-
-	return database_dump, nil
+	return u.uploadBatch(ctx, table_name, data[start:], offset+start, deferred)
 }
 
-// insert a row into the target database and update the mapping if necessary
-func uploadRow(db database, primary_keys map[string][]string, references References, mapping Mapping, table_name string, data map[string]interface{}) (Mapping, error) {
+// insert rows with the same columns into the target database and update the mapping if necessary.
+// primary key columns with a generated value are left out so that the target database generates
+// new values unless primary keys are preserved, all other primary key columns are inserted as they are.
+// offset is the position of the first row within the table, used for error messages
+func (u *uploader) uploadBatch(ctx context.Context, table_name string, data []map[string]interface{}, offset int, deferred []TableReference) error {
+	if len(data) == 0 {
+		return nil
+	}
+	primary_key := u.primary_keys[table_name]
+
 	columns := make([]string, 0)
-	primary_key := ""
-	for key := range data {
-		if !sliceContains(primary_keys[table_name], key) {
-			columns = append(columns, key)
+	returning := make([]string, 0)
+	for key := range data[0] {
+		if sliceContains(primary_key, key) && sliceContains(u.generated_columns[table_name], key) && !u.options.preserve_keys {
+			returning = append(returning, key)
 		} else {
-			primary_key = key // column that has an auto value
-		}
-	}
-
-	values := make([]interface{}, 0)
-	for _, key := range columns {
-		d, exists := getReference(references[table_name], key)
-		if exists {
-			// column contains a value that references another table
-			// --> we need to use the updated value in the reference map
-			if data[key] != nil {
-				ids, exists := mapping[d.referenced_table_name]
-				if exists {
-					values = append(values, ids[fmt.Sprintf("%v", data[key])])
-				} else {
-					// should never be the case as we put the new ids into mapping, but just in case this would use the old value
-					// todo: should we abort with error message?
-					values = append(values, data[key])
-				}
-			} else {
-				values = append(values, nil)
+			columns = append(columns, key)
+		}
+	}
+	sort.Strings(columns)
+	sort.Strings(returning)
+	// without returning columns, rows are inserted with COPY, which writes preserved values into
+	// identity columns like INSERT with OVERRIDING SYSTEM VALUE
+
+	if len(deferred) > 0 && len(primary_key) == 0 {
+		return fmt.Errorf("table %q has no primary key, so its reference %s can't be updated later", table_name, deferred[0])
+	}
+
+	// deferred references are inserted as NULL, the referenced rows may not exist yet
+	references := make([]TableReference, 0)
+	for _, d := range getReferencesFromTable(u.references, table_name) {
+		if !containsReference(deferred, d) {
+			references = append(references, d)
+		}
+	}
+
+	rows := make([]map[string]interface{}, len(data))
+	for i, d := range data {
+		row, err := u.remapReferences(ctx, table_name, d, references)
+		if err != nil {
+			return err
+		}
+		for _, r := range deferred {
+			for _, c := range r.column_names {
+				row[c] = nil
 			}
-		} else {
-			if data[key] != nil {
-				values = append(values, data[key])
-			} else {
-				values = append(values, nil)
+		}
+		rows[i] = row
+	}
+
+	existing, duplicates, err := u.mergeRows(ctx, table_name, rows)
+	if err != nil {
+		return err
+	}
+	inserted := make([]int, 0, len(rows))
+	values := make([][]interface{}, 0, len(rows))
+	for i, row := range rows {
+		if _, exists := existing[i]; !exists && duplicates[i] == i {
+			inserted = append(inserted, i)
+			values = append(values, rowValues(row, columns))
+		}
+	}
+
+	if len(values) > 0 {
+		generated, err := u.db.insertRows(ctx, table_name, columns, values, returning)
+		if err != nil {
+			return &InsertError{Table: table_name, FirstRow: offset, LastRow: offset + len(data) - 1, Err: err}
+		}
+		for j, i := range inserted {
+			for k, c := range returning {
+				rows[i][c] = generated[j][k]
+			}
+		}
+	}
+	if u.options.progress != nil {
+		u.options.progress(table_name, offset+len(data))
+	}
+
+	for i, row := range rows {
+		old_key := rowValues(data[i], primary_key)
+		if key, exists := existing[i]; exists || duplicates[i] != i {
+			// the row isn't inserted, references to it are mapped to the existing row
+			if !exists {
+				key = rowValues(rows[duplicates[i]], primary_key)
+			}
+			if len(primary_key) > 0 {
+				u.addMapping(table_name, old_key, key, true)
 			}
+			continue
 		}
 
+		// natural key values only change if they reference the generated key of another table
+		new_key := rowValues(row, primary_key)
+		if len(primary_key) > 0 {
+			u.addMapping(table_name, old_key, new_key, len(returning) > 0 || u.options.preserve_keys || mappingKey(old_key) != mappingKey(new_key))
+		}
+
+		for _, r := range deferred {
+			if !containsNil(rowValues(data[i], r.column_names)) {
+				u.updates = append(u.updates, deferredUpdate{table_name: table_name, position: offset + i, key: new_key, row: data[i], references: deferred})
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// in merge mode, find the rows of a batch whose natural key already exists in the target database.
+// existing holds the primary key of the existing row by position in the batch, and duplicates the
+// position of the first row in the batch with the same natural key, which is the row itself if it is
+// the first one. without merge mode or natural key, all rows are inserted
+func (u *uploader) mergeRows(ctx context.Context, table_name string, rows []map[string]interface{}) (map[int][]interface{}, map[int]int, error) {
+	existing := make(map[int][]interface{})
+	duplicates := make(map[int]int, len(rows))
+	for i := range rows {
+		duplicates[i] = i
+	}
+	natural_key := u.naturalKey(table_name)
+	if !u.options.merge || len(natural_key) == 0 {
+		return existing, duplicates, nil
 	}
 
-	lastInsertId, err := db.insertRow(table_name, columns, values, primary_key)
+	first := make(map[string]int)
+	values := make([][]interface{}, 0)
+	for i, row := range rows {
+		nk := rowValues(row, natural_key)
+		if containsNil(nk) {
+			// NULL never equals another value, so the row is always inserted
+			continue
+		}
+		if j, exists := first[naturalKeyString(nk)]; exists {
+			duplicates[i] = j
+			continue
+		}
+		first[naturalKeyString(nk)] = i
+		values = append(values, nk)
+	}
+	if len(values) == 0 {
+		return existing, duplicates, nil
+	}
+
+	found, err := u.db.getRows(ctx, rowQuery{table_name: table_name, columns: natural_key, values: values})
 	if err != nil {
-		return mapping, err
+		return nil, nil, err
+	}
+	for _, f := range found {
+		i, exists := first[naturalKeyString(rowValues(f, natural_key))]
+		if !exists {
+			continue
+		}
+		if _, duplicate := existing[i]; duplicate {
+			return nil, nil, fmt.Errorf("the natural key %v of table %q matches more than one row in the target database", rowValues(f, natural_key), table_name)
+		}
+		existing[i] = rowValues(f, u.primary_keys[table_name])
+	}
+	for i, j := range duplicates {
+		if key, exists := existing[j]; exists {
+			existing[i] = key
+			duplicates[i] = i
+		}
 	}
+	return existing, duplicates, nil
+}
 
-	if lastInsertId != -1 {
-		// update mapping
-		ids, exists := mapping[table_name]
-		if exists {
-			ids[fmt.Sprintf("%v", data["id"])] = fmt.Sprintf("%d", lastInsertId)
-		} else {
-			// first entry
-			mapping[table_name] = map[string]string{fmt.Sprintf("%v", data["id"]): fmt.Sprintf("%d", lastInsertId)}
+// set the sequences of the generated primary key columns of all uploaded tables past the
+// preserved values, so that later inserts don't collide with them
+func (u *uploader) resetSequences(ctx context.Context) error {
+	tables := make([]string, 0, len(u.new_keys))
+	for t := range u.new_keys {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+
+	for _, t := range tables {
+		columns := make([]string, 0)
+		for _, c := range u.primary_keys[t] {
+			if sliceContains(u.generated_columns[t], c) {
+				columns = append(columns, c)
+			}
+		}
+		if len(columns) == 0 {
+			continue
+		}
+		if err := u.db.resetSequences(ctx, t, columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get the references of a table that are updated after all rows were inserted
+func (u *uploader) deferredReferences(table_name string) []TableReference {
+	ret := make([]TableReference, 0)
+	for _, r := range u.deferred {
+		if r.table_name == table_name {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// set the deferred references of the uploaded rows, now that all referenced rows exist
+func (u *uploader) updateDeferred(ctx context.Context) error {
+	for _, d := range u.updates {
+		row, err := u.remapReferences(ctx, d.table_name, d.row, d.references)
+		if err != nil {
+			return err
+		}
+		columns := make([]string, 0)
+		for _, r := range d.references {
+			if !containsNil(rowValues(d.row, r.column_names)) {
+				columns = append(columns, r.column_names...)
+			}
+		}
+		if err := u.db.updateRow(ctx, d.table_name, u.primary_keys[d.table_name], d.key, columns, rowValues(row, columns)); err != nil {
+			err = fmt.Errorf("references of the row with the key %v could not be set: %w", rowValues(d.row, u.primary_keys[d.table_name]), err)
+			return &InsertError{Table: d.table_name, FirstRow: d.position, LastRow: d.position, Err: err}
+		}
+	}
+	return nil
+}
+
+// returns a copy of a row in which all values of the given references to the primary key of an
+// uploaded row are replaced by the primary key values of that row in the target database.
+// references to rows that were not uploaded are handled according to the UnmappedPolicy
+func (u *uploader) remapReferences(ctx context.Context, table_name string, data map[string]interface{}, references []TableReference) (map[string]interface{}, error) {
+	row := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		row[k] = v
+	}
+
+	for _, d := range references {
+		primary_key := u.primary_keys[d.referenced_table_name]
+		if !sliceContains(u.tables, d.referenced_table_name) {
+			// the referenced table is outside the schemas of the upload, so the referenced row
+			// wasn't uploaded and its primary key is unknown
+			primary_key = d.referenced_column_names
+		} else if !sameColumns(d.referenced_column_names, primary_key) {
+			// only references to a primary key are tracked in the mapping
+			continue
+		}
+
+		// bring the referencing values into the order of the primary key columns
+		old_key := make([]interface{}, len(primary_key))
+		is_null := false
+		for i, rc := range d.referenced_column_names {
+			v := data[d.column_names[i]]
+			if v == nil {
+				is_null = true
+			}
+			old_key[columnPosition(primary_key, rc)] = v
+		}
+		if is_null {
+			continue
+		}
+
+		new_key, exists := u.new_keys[d.referenced_table_name][mappingKey(old_key)]
+		if !exists {
+			switch u.unmappedPolicy(d) {
+			case UnmappedKeepOriginal:
+				continue
+			case UnmappedSetNull:
+				for _, c := range d.column_names {
+					row[c] = nil
+				}
+				continue
+			case UnmappedLookup:
+				var err error
+				if new_key, err = u.lookupKey(ctx, d.referenced_table_name, old_key); err != nil {
+					return nil, err
+				}
+			default:
+				return nil, &UnmappedReferenceError{Table: table_name, Reference: d, Values: old_key}
+			}
+		}
+		for i, rc := range d.referenced_column_names {
+			row[d.column_names[i]] = new_key[columnPosition(primary_key, rc)]
+		}
+	}
+	return row, nil
+}
+
+// get the policy for a reference to a row that was not uploaded
+func (u *uploader) unmappedPolicy(r TableReference) UnmappedPolicy {
+	for _, ur := range u.options.unmapped_references {
+		rc := ur.reference
+		rc.table = resolveTable(u.tables, []string{"public"}, rc.table)
+		if rc.matches(r) {
+			return ur.policy
+		}
+	}
+	return u.options.unmapped
+}
+
+// get the natural key of a table, nil if none was declared
+func (u *uploader) naturalKey(table_name string) []string {
+	for _, nk := range u.options.natural_keys {
+		if resolveTable(u.tables, []string{"public"}, nk.table) == table_name {
+			return nk.columns
 		}
 	}
+	return nil
+}
+
+// find the primary key in the target database of a row of the source database that was not
+// uploaded: the row is read from the source database and the row of the target database
+// with the same natural key is looked up. the result is added to the mapping
+func (u *uploader) lookupKey(ctx context.Context, table_name string, old_key []interface{}) ([]interface{}, error) {
+	if !sliceContains(u.tables, table_name) {
+		return nil, fmt.Errorf("rows of table %q can't be looked up, as it is not part of the schemas of the upload", table_name)
+	}
+	natural_key := u.naturalKey(table_name)
+	if len(natural_key) == 0 {
+		return nil, fmt.Errorf("rows of table %q can't be looked up without a natural key", table_name)
+	}
+	if u.options.source == nil {
+		return nil, fmt.Errorf("rows of table %q can't be looked up without a source database", table_name)
+	}
+	primary_key := u.primary_keys[table_name]
+
+	source_rows, err := u.options.source.getRows(ctx, rowQuery{table_name: table_name, columns: primary_key, values: [][]interface{}{old_key}})
+	if err != nil {
+		return nil, err
+	}
+	if len(source_rows) != 1 {
+		return nil, fmt.Errorf("row %v of table %q was not found in the source database", old_key, table_name)
+	}
+
+	natural_values := rowValues(source_rows[0], natural_key)
+	target_rows, err := u.db.getRows(ctx, rowQuery{table_name: table_name, columns: natural_key, values: [][]interface{}{natural_values}})
+	if err != nil {
+		return nil, err
+	}
+	if len(target_rows) != 1 {
+		return nil, fmt.Errorf("%d rows of table %q in the target database have the natural key %v", len(target_rows), table_name, natural_values)
+	}
+
+	new_key := rowValues(target_rows[0], primary_key)
+	u.addMapping(table_name, old_key, new_key, true)
+	return new_key, nil
+}
+
+// remember which primary key values a row got in the target database. only rows whose
+// values changed are added to the Mapping
+func (u *uploader) addMapping(table_name string, old_key []interface{}, new_key []interface{}, changed bool) {
+	key := mappingKey(old_key)
+	if _, exists := u.new_keys[table_name]; !exists {
+		u.new_keys[table_name] = make(map[string][]interface{})
+	}
+	u.new_keys[table_name][key] = new_key
 
-	return mapping, nil
+	if !changed {
+		return
+	}
+	if _, exists := u.mapping[table_name]; !exists {
+		// first entry
+		u.mapping[table_name] = make(map[string]string)
+	}
+	u.mapping[table_name][key] = mappingKey(new_key)
 }
 
 // ----- HELPER FUNCTIONS -----
 
+// qualify a table name with the first of the schemas that contains the table.
+// names that are already qualified or can't be found are returned unchanged
+func resolveTable(tables []string, schemas []string, table_name string) string {
+	if sliceContains(tables, table_name) {
+		return table_name
+	}
+	for _, s := range schemas {
+		if sliceContains(tables, s+"."+table_name) {
+			return s + "." + table_name
+		}
+	}
+	return table_name
+}
+
+// get the schemas of all tables in a dump. tables without a schema belong to the public schema
+func dumpSchemas(data DatabaseDump) []string {
+	tables := make([]string, 0, len(data))
+	for t := range data {
+		tables = append(tables, t)
+	}
+	return tableSchemas(tables)
+}
+
+// get the schemas of a list of tables. tables without a schema belong to the public schema
+func tableSchemas(tables []string) []string {
+	schemas := make([]string, 0)
+	for _, t := range tables {
+		s := "public"
+		if i := strings.Index(t, "."); i != -1 {
+			s = t[:i]
+		}
+		if !sliceContains(schemas, s) {
+			schemas = append(schemas, s)
+		}
+	}
+	return schemas
+}
+
+// returns a copy of the mapping of a table, nil if the table has no mapping
+func copyTableMapping(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string]string, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// returns a copy of the target primary keys of a table, nil if the table has none
+func copyTableKeys(m map[string][]interface{}) map[string][]interface{} {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[string][]interface{}, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
 func sliceContains(mySlice []string, searchString string) bool {
 	for _, s := range mySlice {
 		if s == searchString {
@@ -194,27 +891,105 @@ func sliceContains(mySlice []string, searchString string) bool {
 	return false
 }
 
-// check whether dump already contains the result of a previous select-query.
-// used to stop recursion so that queries are not repeated
-func dumpContainsResultOfQuery(database_dump DatabaseDump, table_name string, col string, val interface{}) bool {
-	var rows = database_dump[table_name]
-	for _, r := range rows {
-		v, ok := r[col]
-		if ok && v == val {
+// check whether a row references one of the pending rows of its own table
+func referencesPending(self_references []TableReference, pending lookupIndex, row map[string]interface{}) bool {
+	for _, d := range self_references {
+		vals := rowValues(row, d.column_names)
+		if !containsNil(vals) && pending.contains(d.table_name, d.referenced_column_names, vals) {
 			return true
 		}
 	}
 	return false
 }
 
-// check whether dump already contains data from a previously selected row.
-// used to prevent duplicate data in the dump, because the same row can
-// be selected via different select-queries
-func dumpContainsRow(data []map[string]interface{}, row map[string]interface{}) bool {
-	for _, currMap := range data {
-		if reflect.DeepEqual(currMap, row) {
+// get a key that identifies the set of columns of a row
+func columnsKey(row map[string]interface{}) string {
+	columns := make([]string, 0, len(row))
+	for c := range row {
+		columns = append(columns, c)
+	}
+	sort.Strings(columns)
+	return strings.Join(columns, "\x00")
+}
+
+// format the values of a primary key as used in the Mapping. a single value is formatted as is,
+// multiple values are formatted as a tuple like (1,abc)
+func mappingKey(vals []interface{}) string {
+	if len(vals) == 1 {
+		return formatValue(vals[0])
+	}
+	parts := make([]string, len(vals))
+	for i, v := range vals {
+		parts[i] = formatValue(v)
+		if strings.ContainsAny(parts[i], ",()\"\\ ") {
+			parts[i] = strconv.Quote(parts[i])
+		}
+	}
+	return "(" + strings.Join(parts, ",") + ")"
+}
+
+// format natural key values for comparison. times are compared in UTC, as the database
+// returns them in its session time zone rather than the offset of the dump
+func naturalKeyString(vals []interface{}) string {
+	normalized := make([]interface{}, len(vals))
+	for i, v := range vals {
+		if t, ok := v.(time.Time); ok {
+			v = t.UTC()
+		}
+		normalized[i] = v
+	}
+	return mappingKey(normalized)
+}
+
+// format a single column value as text
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// check whether two lists contain the same columns, regardless of their order
+func sameColumns(a []string, b []string) bool {
+	if len(a) != len(b) || len(a) == 0 {
+		return false
+	}
+	for _, c := range a {
+		if !sliceContains(b, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// get the position of a column in a list of columns, -1 if it is not contained
+func columnPosition(cols []string, col string) int {
+	for i, c := range cols {
+		if c == col {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasColumn(columns []column, name string) bool {
+	for _, c := range columns {
+		if c.name == name {
 			return true
 		}
 	}
 	return false
 }
+
+// get the values of the given columns of a row in the order of the columns
+func rowValues(row map[string]interface{}, cols []string) []interface{} {
+	vals := make([]interface{}, len(cols))
+	for i, c := range cols {
+		vals[i] = row[c]
+	}
+	return vals
+}
@@ -1,20 +1,65 @@
 package sqlclone
 
+import (
+	"fmt"
+	"strings"
+)
+
+// TableReference describes a foreign key constraint. the column at position i
+// in column_names references the column at position i in referenced_column_names
 type TableReference struct {
-	table_name             string
-	column_name            string
-	referenced_table_name  string
-	referenced_column_name string
+	constraint_name         string
+	table_name              string
+	column_names            []string
+	referenced_table_name   string
+	referenced_column_names []string
 }
 
-// Constructor function
+// Constructor function for a reference that consists of a single column
 func NewTableReference(t string, c string, rt string, rc string) *TableReference {
+	return NewCompositeTableReference("", t, []string{c}, rt, []string{rc})
+}
+
+// Constructor function for a reference that consists of one or more column pairs
+func NewCompositeTableReference(name string, t string, cs []string, rt string, rcs []string) *TableReference {
 	ref := &TableReference{
-		table_name:             t,
-		column_name:            c,
-		referenced_table_name:  rt,
-		referenced_column_name: rc,
+		constraint_name:         name,
+		table_name:              t,
+		column_names:            cs,
+		referenced_table_name:   rt,
+		referenced_column_names: rcs,
 	}
 
 	return ref
 }
+
+// formats the reference as e.g. "purchase.person_id -> person.id"
+func (r TableReference) String() string {
+	return fmt.Sprintf("%s.%s -> %s.%s", r.table_name, strings.Join(r.column_names, ","),
+		r.referenced_table_name, strings.Join(r.referenced_column_names, ","))
+}
+
+// encodes the reference as its string, e.g. in the JSON encoding of a Provenance
+func (r TableReference) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// a column or constraint of a table that identifies a reference
+type referenceColumn struct {
+	table  string
+	column string
+}
+
+// parse a reference given as "table.column" or "table.constraint_name"
+func parseReferenceColumn(reference string) referenceColumn {
+	rc := referenceColumn{column: reference}
+	if pos := strings.LastIndex(reference, "."); pos >= 0 {
+		rc.table, rc.column = reference[:pos], reference[pos+1:]
+	}
+	return rc
+}
+
+// whether the column or constraint is part of a reference
+func (rc referenceColumn) matches(r TableReference) bool {
+	return rc.table == r.table_name && (rc.column == r.constraint_name || sliceContains(r.column_names, rc.column))
+}
@@ -0,0 +1,179 @@
+package sqlclone
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// the text representation of values of postgres types that have no corresponding Go type.
+// they are used as values in a DatabaseDump so that their type is kept when it is encoded
+type (
+	Numeric string
+	UUID    string
+	JSON    string
+	Array   string
+)
+
+// a column value together with its type, so that it can be encoded as JSON without losing
+// type information. NULL is encoded as null, all other values as {"t": type, "v": value}
+type typedValue struct {
+	value interface{}
+}
+
+type encodedValue struct {
+	Type  string `json:"t"`
+	Value string `json:"v"`
+}
+
+func (tv typedValue) MarshalJSON() ([]byte, error) {
+	if tv.value == nil {
+		return []byte("null"), nil
+	}
+	e, err := encodeValue(tv.value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// values without type information, as written by json.Marshal before DatabaseDump
+// implemented json.Marshaler, are decoded as plain JSON values
+func (tv *typedValue) UnmarshalJSON(b []byte) error {
+	var e encodedValue
+	if err := json.Unmarshal(b, &e); err == nil && e.Type != "" {
+		v, err := decodeValue(e)
+		if err != nil {
+			return err
+		}
+		tv.value = v
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			tv.value = i
+		} else if f, err := x.Float64(); err == nil {
+			tv.value = f
+		} else {
+			tv.value = Numeric(x)
+		}
+	case map[string]interface{}, []interface{}:
+		tv.value = JSON(b)
+	default:
+		tv.value = x
+	}
+	return nil
+}
+
+func (dump DatabaseDump) MarshalJSON() ([]byte, error) {
+	typed := make(map[string][]map[string]typedValue, len(dump))
+	for t, rows := range dump {
+		typed[t] = make([]map[string]typedValue, len(rows))
+		for i, r := range rows {
+			typed[t][i] = make(map[string]typedValue, len(r))
+			for c, v := range r {
+				typed[t][i][c] = typedValue{v}
+			}
+		}
+	}
+	return json.Marshal(typed)
+}
+
+func (dump *DatabaseDump) UnmarshalJSON(b []byte) error {
+	var typed map[string][]map[string]typedValue
+	if err := json.Unmarshal(b, &typed); err != nil {
+		return err
+	}
+	if *dump == nil {
+		*dump = make(DatabaseDump, len(typed))
+	}
+	for t, rows := range typed {
+		(*dump)[t] = make([]map[string]interface{}, len(rows))
+		for i, r := range rows {
+			(*dump)[t][i] = make(map[string]interface{}, len(r))
+			for c, v := range r {
+				(*dump)[t][i][c] = v.value
+			}
+		}
+	}
+	return nil
+}
+
+func encodeValue(val interface{}) (encodedValue, error) {
+	switch v := val.(type) {
+	case []byte:
+		return encodedValue{"bytes", base64.StdEncoding.EncodeToString(v)}, nil
+	case string:
+		return encodedValue{"string", v}, nil
+	case bool:
+		return encodedValue{"bool", strconv.FormatBool(v)}, nil
+	case time.Time:
+		return encodedValue{"time", v.Format(time.RFC3339Nano)}, nil
+	case Numeric:
+		return encodedValue{"numeric", string(v)}, nil
+	case UUID:
+		return encodedValue{"uuid", string(v)}, nil
+	case JSON:
+		return encodedValue{"json", string(v)}, nil
+	case Array:
+		return encodedValue{"array", string(v)}, nil
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodedValue{"int", strconv.FormatInt(rv.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if rv.Uint() > math.MaxInt64 {
+			// doesn't fit into the int64 that an int is decoded to
+			return encodedValue{"uint", strconv.FormatUint(rv.Uint(), 10)}, nil
+		}
+		return encodedValue{"int", strconv.FormatUint(rv.Uint(), 10)}, nil
+	case reflect.Float32, reflect.Float64:
+		return encodedValue{"float", strconv.FormatFloat(rv.Float(), 'g', -1, 64)}, nil
+	case reflect.String:
+		return encodedValue{"string", rv.String()}, nil
+	}
+	return encodedValue{}, fmt.Errorf("value %v of type %T can't be encoded", val, val)
+}
+
+func decodeValue(e encodedValue) (interface{}, error) {
+	switch e.Type {
+	case "bytes":
+		return base64.StdEncoding.DecodeString(e.Value)
+	case "string":
+		return e.Value, nil
+	case "bool":
+		return strconv.ParseBool(e.Value)
+	case "time":
+		return time.Parse(time.RFC3339Nano, e.Value)
+	case "int":
+		return strconv.ParseInt(e.Value, 10, 64)
+	case "uint":
+		return strconv.ParseUint(e.Value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(e.Value, 64)
+	case "numeric":
+		return Numeric(e.Value), nil
+	case "uuid":
+		return UUID(e.Value), nil
+	case "json":
+		return JSON(e.Value), nil
+	case "array":
+		return Array(e.Value), nil
+	}
+	return nil, fmt.Errorf("value %q has unknown type %q", e.Value, e.Type)
+}
@@ -0,0 +1,132 @@
+package sqlclone
+
+import (
+	"database/sql"
+)
+
+type uploadOptions struct {
+	savepoint_per_table bool
+	logger              Logger
+	progress            Progress
+	// what happens to references to rows that weren't uploaded, by default and per reference
+	unmapped            UnmappedPolicy
+	unmapped_references []unmappedReference
+	natural_keys        []naturalKey
+	// rows whose natural key exists in the target database are reused instead of inserted
+	merge bool
+	// generated primary key values are inserted as they are in the dump
+	preserve_keys bool
+	// the source database that rows are looked up in by UnmappedLookup
+	source database
+}
+
+// UnmappedPolicy decides what happens to a reference to a row that is not part of the upload,
+// e.g. because its table was excluded with DontRecurse, so the referenced row has no primary key
+// in the target database
+type UnmappedPolicy int
+
+const (
+	// Upload fails with an *UnmappedReferenceError
+	UnmappedError UnmappedPolicy = iota
+	// the reference is inserted as NULL
+	UnmappedSetNull
+	// the reference keeps the primary key of the source database
+	UnmappedKeepOriginal
+	// the referenced row is read from the source database given with LookupSource, and the
+	// row of the target database with the same natural key, declared with NaturalKey, is referenced
+	UnmappedLookup
+)
+
+type unmappedReference struct {
+	reference referenceColumn
+	policy    UnmappedPolicy
+}
+
+// the columns that identify a row of a table in both databases
+type naturalKey struct {
+	table   string
+	columns []string
+}
+
+type UploadOption func(*uploadOptions)
+
+// Constructor function
+func newUploadOptions(opts ...UploadOption) *uploadOptions {
+	uo := &uploadOptions{}
+
+	for _, opt := range opts {
+		opt(uo)
+	}
+
+	return uo
+}
+
+// Upload the rows of every table within its own savepoint. a table whose rows can't be uploaded
+// is rolled back to its savepoint and skipped, and the rows of all other tables are committed.
+// Upload returns a *SkippedTablesError with the mapping of the committed rows then
+func SavepointPerTable() UploadOption {
+	return func(uo *uploadOptions) {
+		uo.savepoint_per_table = true
+	}
+}
+
+// Log the statements on the target database at debug level
+func UploadLogger(l Logger) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.logger = l
+	}
+}
+
+// Report the number of uploaded rows per table after every inserted batch
+func UploadProgress(p Progress) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.progress = p
+	}
+}
+
+// Set what happens to references to rows that are not part of the upload. defaults to UnmappedError
+func OnUnmapped(policy UnmappedPolicy) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.unmapped = policy
+	}
+}
+
+// Set what happens to a single reference, given as "table.column" or "table.constraint_name",
+// if it references a row that is not part of the upload. overrides OnUnmapped
+func OnUnmappedReference(reference string, policy UnmappedPolicy) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.unmapped_references = append(uo.unmapped_references, unmappedReference{reference: parseReferenceColumn(reference), policy: policy})
+	}
+}
+
+// Declare the columns that identify a row of a table in the source and the target database,
+// e.g. NaturalKey("company", "name")
+func NaturalKey(table string, columns ...string) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.natural_keys = append(uo.natural_keys, naturalKey{table: table, columns: columns})
+	}
+}
+
+// Set the source database that referenced rows are read from by UnmappedLookup
+func LookupSource(db *sql.DB) UploadOption {
+	return func(uo *uploadOptions) {
+		uo.source = postgresDB{queryer: db}
+	}
+}
+
+// Rows of tables with a NaturalKey that already exist in the target database are not inserted
+// again. references to them are mapped to the existing rows, which are left unchanged
+func MergeOnNaturalKeys() UploadOption {
+	return func(uo *uploadOptions) {
+		uo.merge = true
+	}
+}
+
+// Insert the values of generated primary key columns as they are in the dump instead of letting
+// the target database generate new ones, e.g. to clone into an empty database. the Mapping maps
+// every row to itself, and the sequences of the columns are set past the highest value afterwards
+func PreservePrimaryKeys() UploadOption {
+	return func(uo *uploadOptions) {
+		uo.preserve_keys = true
+	}
+}
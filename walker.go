@@ -0,0 +1,290 @@
+package sqlclone
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// a lookup of rows that still has to be executed while walking the graph of references
+type lookup struct {
+	table_name string
+	columns    []string
+	values     []interface{}
+	// the reference that was followed to reach the lookup and the lookup of the row it was
+	// followed from, both nil for a starting point
+	reference *TableReference
+	via       *lookup
+	// number of references that were followed to parents and to children to reach the lookup
+	parent_depth int
+	child_depth  int
+}
+
+// lookups on the same columns of a table, executed as a single query
+type lookupGroup struct {
+	rowQuery
+	// the lookups by the canonical encoding of their values
+	lookups map[string]lookup
+	first   lookup
+}
+
+// get the chain of references that was followed from a starting point to reach the lookup
+func (l lookup) path() []TableReference {
+	ret := make([]TableReference, 0)
+	for c := &l; c.reference != nil; c = c.via {
+		ret = append([]TableReference{*c.reference}, ret...)
+	}
+	return ret
+}
+
+// get the lookup of the starting point from which the lookup was reached
+func (l lookup) root() lookup {
+	for l.via != nil {
+		l = *l.via
+	}
+	return l
+}
+
+// get the lookup by which a row was found
+func (g lookupGroup) lookupOf(r map[string]interface{}) lookup {
+	if l, exists := g.lookups[canonicalTuple(rowValues(r, g.columns))]; exists {
+		return l
+	}
+	return g.first
+}
+
+// walks the graph of references level by level, starting at a list of lookups.
+// all lookups of a level that target the same columns of a table are executed as one query
+type graphWalker struct {
+	db           database
+	references   References
+	primary_keys map[string][]string
+	options      *downloadOptions
+	dump         DatabaseDump
+	index        *dumpIndex
+	executed     lookupIndex
+	// the depths at which rows and lookups were reached, only kept if the depth is limited
+	depths map[string][]lookupDepth
+	limits *limitCounter
+	// maskers per table and column
+	masks map[string]map[string]Masker
+	// the columns to get of the rows per table, all columns of tables that are missing
+	projections map[string][]string
+	// called for every row that is added to the dump, if set
+	visit func(l lookup, r map[string]interface{})
+}
+
+// Constructor function, the table names in the options have to be resolved already
+func newGraphWalker(db database, references References, primary_keys map[string][]string, options *downloadOptions) *graphWalker {
+	w := &graphWalker{
+		db:           db,
+		references:   references,
+		primary_keys: primary_keys,
+		options:      options,
+		dump:         make(DatabaseDump),
+		index:        newDumpIndex(primary_keys),
+		executed:     make(lookupIndex),
+		depths:       make(map[string][]lookupDepth),
+		limits:       newLimitCounter(options),
+		masks:        make(map[string]map[string]Masker),
+	}
+	for _, m := range options.masks {
+		if w.masks[m.table] == nil {
+			w.masks[m.table] = make(map[string]Masker)
+		}
+		w.masks[m.table][m.column] = m.masker
+	}
+	return w
+}
+
+// collect all rows that are reachable from the given lookups into the dump
+func (w *graphWalker) walk(ctx context.Context, start []lookup) error {
+	if w.options.provenance != nil {
+		*w.options.provenance = make(Provenance)
+	}
+
+	queue := start
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		next := make([]lookup, 0)
+		for _, q := range w.group(queue) {
+			rows, err := w.db.getRows(ctx, q.rowQuery)
+			if err != nil {
+				return err
+			}
+			for _, r := range rows {
+				l := q.lookupOf(r)
+				if !w.index.add(q.table_name, r) {
+					// a row that is already part of the dump is followed again if it was reached by a
+					// shorter path, which may follow references that the depth limits excluded before
+					if w.reachedAt("\x00row\x00"+q.table_name+"\x00"+w.index.rowKey(q.table_name, r), l) {
+						next = append(next, w.follow(l, r)...)
+					}
+					continue
+				}
+				w.reachedAt("\x00row\x00"+q.table_name+"\x00"+w.index.rowKey(q.table_name, r), l)
+
+				masked, err := w.mask(q.table_name, r)
+				if err != nil {
+					return err
+				}
+				if limit := w.limits.add(q.table_name, masked); limit != "" {
+					return &LimitError{Limit: limit, Table: q.table_name, Reference: l.reference, Dump: w.dump}
+				}
+				w.dump[q.table_name] = append(w.dump[q.table_name], masked)
+				if w.options.provenance != nil {
+					(*w.options.provenance)[q.table_name] = append((*w.options.provenance)[q.table_name], newRowProvenance(l))
+				}
+				if w.visit != nil {
+					w.visit(l, masked)
+				}
+
+				// a lookup by the primary key can't find anything but this row
+				if primary_key := w.primary_keys[q.table_name]; len(primary_key) > 0 {
+					w.executed.add(q.table_name, primary_key, rowValues(r, primary_key))
+					w.reachedAt(lookupKey(q.table_name, primary_key, rowValues(r, primary_key)), l)
+				}
+
+				next = append(next, w.follow(l, r)...)
+			}
+			if w.options.progress != nil && len(rows) > 0 {
+				w.options.progress(q.table_name, len(w.dump[q.table_name]))
+			}
+		}
+		queue = next
+	}
+	return nil
+}
+
+// get the lookups for all rows that reference a row or are referenced by it.
+// l is the lookup by which the row itself was found
+func (w *graphWalker) follow(l lookup, r map[string]interface{}) []lookup {
+	ret := make([]lookup, 0)
+	parent_depth, child_depth := l.parent_depth+1, l.child_depth+1
+
+	if !w.options.children_only && (w.options.max_parent_depth == 0 || parent_depth <= w.options.max_parent_depth) {
+		for _, d := range getReferencesFromTable(w.references, l.table_name) {
+			vals := rowValues(r, d.column_names)
+			if containsNil(vals) || sliceContains(w.options.dont_recurse, d.referenced_table_name) || w.options.isNotFollowed(d) ||
+				(!w.depthLimited() && w.executed.contains(d.referenced_table_name, d.referenced_column_names, vals)) {
+				continue
+			}
+			ret = append(ret, lookup{table_name: d.referenced_table_name, columns: d.referenced_column_names, values: vals,
+				reference: ref(d), via: &l, parent_depth: parent_depth, child_depth: l.child_depth})
+		}
+	}
+
+	if !w.options.parents_only && (w.options.max_child_depth == 0 || child_depth <= w.options.max_child_depth) {
+		for _, d := range getReferencesToTable(w.references, l.table_name) {
+			vals := rowValues(r, d.referenced_column_names)
+			if containsNil(vals) || sliceContains(w.options.dont_recurse, d.table_name) || w.options.isNotFollowed(d) ||
+				(!w.depthLimited() && w.executed.contains(d.table_name, d.column_names, vals)) {
+				continue
+			}
+			ret = append(ret, lookup{table_name: d.table_name, columns: d.column_names, values: vals,
+				reference: ref(d), via: &l, parent_depth: l.parent_depth, child_depth: child_depth})
+		}
+	}
+
+	return ret
+}
+
+// get the filters of a table
+func (w *graphWalker) filters(table_name string) []rowFilter {
+	ret := make([]rowFilter, 0)
+	for _, f := range w.options.filters {
+		if f.table == table_name {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// returns a copy of a row in which the masked columns are replaced by their masked values
+func (w *graphWalker) mask(table_name string, r map[string]interface{}) (map[string]interface{}, error) {
+	masks := w.masks[table_name]
+	if len(masks) == 0 {
+		return r, nil
+	}
+
+	masked := make(map[string]interface{}, len(r))
+	for c, v := range r {
+		masked[c] = v
+		if m, exists := masks[c]; exists {
+			mv, err := m(v)
+			if err != nil {
+				return nil, fmt.Errorf("column %q of table %q could not be masked: %w", c, table_name, err)
+			}
+			masked[c] = mv
+		}
+	}
+	return masked, nil
+}
+
+// combine lookups on the same columns of the same table into a single query, keeping
+// the order in which the tables and columns appear first. lookups that were already
+// executed are left out
+func (w *graphWalker) group(lookups []lookup) []lookupGroup {
+	ret := make([]lookupGroup, 0)
+	positions := make(map[string]int)
+	for _, l := range lookups {
+		// a lookup that was executed before is executed again if it was reached by a shorter path
+		shorter := w.reachedAt(lookupKey(l.table_name, l.columns, l.values), l)
+		if !w.executed.add(l.table_name, l.columns, l.values) && !shorter {
+			continue
+		}
+		key := l.table_name + "\x00" + strings.Join(l.columns, "\x00")
+		pos, exists := positions[key]
+		if !exists {
+			pos = len(ret)
+			positions[key] = pos
+			ret = append(ret, lookupGroup{
+				rowQuery: rowQuery{
+					table_name: l.table_name,
+					columns:    l.columns,
+					filters:    w.filters(l.table_name),
+					projection: w.projections[l.table_name],
+				},
+				lookups: make(map[string]lookup),
+				first:   l,
+			})
+		}
+		ret[pos].values = append(ret[pos].values, l.values)
+		ret[pos].lookups[canonicalTuple(l.values)] = l
+	}
+	return ret
+}
+
+// the number of references that were followed to parents and to children to reach a row or lookup
+type lookupDepth struct {
+	parent_depth int
+	child_depth  int
+}
+
+// whether the number of followed references is limited
+func (w *graphWalker) depthLimited() bool {
+	return w.options.max_parent_depth > 0 || w.options.max_child_depth > 0
+}
+
+// record the depths at which a row or lookup was reached. returns whether no earlier visit
+// reached it with depths that are both smaller or equal, so that it has to be followed again.
+// always false if the depth isn't limited, as every visit follows the same references then
+func (w *graphWalker) reachedAt(key string, l lookup) bool {
+	if !w.depthLimited() {
+		return false
+	}
+	for _, d := range w.depths[key] {
+		if d.parent_depth <= l.parent_depth && d.child_depth <= l.child_depth {
+			return false
+		}
+	}
+	w.depths[key] = append(w.depths[key], lookupDepth{parent_depth: l.parent_depth, child_depth: l.child_depth})
+	return true
+}
+
+// returns a pointer to a copy of a reference
+func ref(r TableReference) *TableReference {
+	return &r
+}